@@ -0,0 +1,707 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/aof"
+)
+
+// aofRewriteRetryDelay is how long after a failed rewrite an automatic one
+// may be tried again.
+const aofRewriteRetryDelay = 5 * time.Second
+
+// aofState is the append only file. Every write that changed the dataset
+// is appended, in the same RESP form replicas receive, to the current
+// incremental file of the AOF directory. Its manifest lists a base file,
+// written by the last rewrite, followed by the incremental files; loading
+// them in order rebuilds the dataset. It is guarded by db.mu.
+type aofState struct {
+	// file is the incremental file being appended to, nil while
+	// appendonly is off.
+	file     *os.File
+	manifest *aof.Manifest
+	// buf holds what a failed write could not append; it is retried
+	// before anything else is written, so the file never misses a command.
+	buf []byte
+	// size is the total size of the files in the manifest, and baseSize
+	// what it was after the last rewrite; auto rewrites compare the two.
+	size     int64
+	baseSize int64
+	// lastWriteErr is the error of the last failed write or fsync, nil
+	// once the file is healthy again.
+	lastWriteErr error
+	// unsynced is set by writes not yet fsynced under appendfsync
+	// everysec.
+	unsynced bool
+	// waitRewrite is set when appendonly was turned on at runtime: writes
+	// go to a temporary incremental file, which only joins the manifest
+	// with the base of the first rewrite.
+	waitRewrite bool
+	// started is set once the dataset was loaded; from then on turning
+	// appendonly on or off starts or stops logging.
+	started bool
+
+	rewriteInProgress  bool
+	rewriteStart       time.Time
+	lastRewriteOK      bool
+	lastRewriteSeconds int64
+	rewrites           int64
+	// rewriteGen identifies the running rewrite; a rewrite whose
+	// generation is no longer current was aborted and its result is
+	// thrown away.
+	rewriteGen int64
+	// rewriteIncrs is the number of incremental files the running
+	// rewrite replaces: those written before it took its snapshot.
+	rewriteIncrs int
+}
+
+var aofLog = aofState{lastRewriteOK: true, lastRewriteSeconds: -1}
+
+func aofPath(config *Config, name string) string {
+	return path.Join(config.rdb_dir, config.AppendDirname, name)
+}
+
+func tempIncrName(config *Config) string {
+	return "temp-" + config.AppendFilename + ".incr"
+}
+
+// loadDataFromDisk fills the keyspace before the server accepts
+// connections, from the AOF when appendonly is on and from the RDB file
+// otherwise.
+func loadDataFromDisk(config *Config) {
+	if config.AppendOnly {
+		initAppendOnly(config)
+	} else {
+		loadRDB(config)
+	}
+	aofLog.started = true
+}
+
+// feedAppendOnlyFile appends a write command to the AOF, if enabled. The
+// keyspace must be locked.
+func feedAppendOnlyFile(parts []string, config *Config) {
+	if aofLog.file == nil {
+		return
+	}
+	aofLog.buf = append(aofLog.buf, buildRespArray(parts)...)
+	flushAppendOnlyFile(config)
+}
+
+// flushAppendOnlyFile writes the pending buffer, and fsyncs it under
+// appendfsync always. A failed write keeps what was not written for the
+// next attempt and makes rejectWriteOnDiskError refuse writes meanwhile;
+// under appendfsync always the server exits instead, as a reply may only
+// be sent once its command is on disk. The keyspace must be locked.
+func flushAppendOnlyFile(config *Config) {
+	if aofLog.file == nil || len(aofLog.buf) == 0 {
+		return
+	}
+	n, err := aofLog.file.Write(aofLog.buf)
+	aofLog.size += int64(n)
+	aofLog.buf = aofLog.buf[n:]
+	if err == nil && config.AppendFsync == "always" {
+		err = aofLog.file.Sync()
+	}
+	if err != nil {
+		if config.AppendFsync == "always" {
+			fmt.Println("Can't recover from AOF write error when the AOF fsync policy is 'always'. Exiting...")
+			os.Exit(1)
+		}
+		if aofLog.lastWriteErr == nil {
+			fmt.Println("Error writing to the AOF file:", err)
+		}
+		aofLog.lastWriteErr = err
+		return
+	}
+	if len(aofLog.buf) == 0 {
+		aofLog.buf = nil
+	}
+	if aofLog.lastWriteErr != nil {
+		fmt.Println("AOF write error looks solved, Redis can write again.")
+		aofLog.lastWriteErr = nil
+	}
+	aofLog.unsynced = config.AppendFsync == "everysec"
+}
+
+// aofCron runs once per second. It retries failed AOF writes, starts
+// automatic rewrites and, under appendfsync everysec, fsyncs the file. The
+// fsync runs without the keyspace locked so a slow disk does not stall
+// clients.
+func aofCron(config *Config) {
+	for {
+		time.Sleep(time.Second)
+		db.mu.Lock()
+		flushAppendOnlyFile(config)
+		checkAOFRewrite(config)
+		f := aofLog.file
+		sync := f != nil && aofLog.unsynced && config.AppendFsync == "everysec"
+		aofLog.unsynced = false
+		db.mu.Unlock()
+		if !sync {
+			continue
+		}
+		// A rewrite may have switched to a new file meanwhile; the old one
+		// is synced as it is closed.
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			db.mu.Lock()
+			if aofLog.lastWriteErr == nil {
+				fmt.Println("Error syncing the AOF file:", err)
+			}
+			aofLog.lastWriteErr = err
+			db.mu.Unlock()
+		}
+	}
+}
+
+// checkAOFRewrite starts a rewrite once the AOF grew by
+// auto-aof-rewrite-percentage since the last one and is larger than
+// auto-aof-rewrite-min-size, or when appendonly was turned on and its first
+// rewrite failed. The keyspace must be locked.
+func checkAOFRewrite(config *Config) {
+	if aofLog.file == nil || aofLog.rewriteInProgress ||
+		(!aofLog.lastRewriteOK && time.Since(aofLog.rewriteStart) < aofRewriteRetryDelay) {
+		return
+	}
+	if aofLog.waitRewrite {
+		startAOFRewrite(config)
+		return
+	}
+	if config.AutoAOFRewritePercentage == 0 || aofLog.size < config.AutoAOFRewriteMinSize {
+		return
+	}
+	growth := aofLog.size*100/max(aofLog.baseSize, 1) - 100
+	if growth >= int64(config.AutoAOFRewritePercentage) {
+		fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+		startAOFRewrite(config)
+	}
+}
+
+// initAppendOnly loads the dataset from the AOF directory and opens its
+// last incremental file for appending. An AOF from before the directory
+// layout becomes the base of a new manifest. Without any AOF the dataset
+// comes from the RDB file and is written as the first base, so turning
+// appendonly on does not lose what was snapshotted.
+func initAppendOnly(config *Config) {
+	if err := os.MkdirAll(path.Join(config.rdb_dir, config.AppendDirname), 0755); err != nil {
+		fmt.Println("Can't create the append-only directory:", err)
+		os.Exit(1)
+	}
+	m, err := aof.LoadManifest(aofPath(config, aof.ManifestName(config.AppendFilename)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Println("Error reading the AOF manifest:", err)
+		os.Exit(1)
+	}
+	if m == nil {
+		m = upgradeAppendOnlyFile(config)
+	}
+	if m == nil {
+		loadRDB(config)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if m != nil {
+		loadAppendOnlyFiles(config, m)
+	} else {
+		m = &aof.Manifest{BaseSeq: 1}
+		m.Base = &aof.File{Name: aof.BaseName(config.AppendFilename, 1, true), Seq: 1, Type: aof.TypeBase}
+		if err := writeRewriteFile(aofPath(config, m.Base.Name), db.snapshot()); err != nil {
+			fmt.Println("Error writing the AOF base file:", err)
+			os.Exit(1)
+		}
+	}
+	aofLog.manifest = m
+
+	if n := len(m.Incrs); n > 0 {
+		f, err := os.OpenFile(aofPath(config, m.Incrs[n-1].Name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Println("Can't open the append-only file:", err)
+			os.Exit(1)
+		}
+		aofLog.file = f
+	} else if err := openNewIncr(config); err != nil {
+		fmt.Println("Can't open the append-only file:", err)
+		os.Exit(1)
+	}
+	aofLog.size = aofFilesSize(config, m)
+	aofLog.baseSize = aofLog.size
+}
+
+// upgradeAppendOnlyFile moves a single-file AOF from dir into the AOF
+// directory as the base of a new manifest, and returns that manifest, or
+// nil if there is no such file.
+func upgradeAppendOnlyFile(config *Config) *aof.Manifest {
+	old := path.Join(config.rdb_dir, config.AppendFilename)
+	if _, err := os.Stat(old); err != nil {
+		return nil
+	}
+	m := &aof.Manifest{
+		Base:    &aof.File{Name: config.AppendFilename, Seq: 1, Type: aof.TypeBase},
+		BaseSeq: 1,
+	}
+	err := os.Rename(old, aofPath(config, config.AppendFilename))
+	if err == nil {
+		err = persistManifest(config, m)
+	}
+	if err != nil {
+		fmt.Println("Error upgrading the append only file:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Successfully migrated an old-style AOF into the AOF directory")
+	return m
+}
+
+// writeRewriteFile writes entries as an RDB file, the format of every base
+// file written here, and fsyncs it.
+func writeRewriteFile(filename string, entries []snapshotEntry) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = writeRDB(f, entries, true)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
+
+// persistManifest replaces the manifest file with m, atomically.
+func persistManifest(config *Config, m *aof.Manifest) error {
+	final := aofPath(config, aof.ManifestName(config.AppendFilename))
+	tmp := aofPath(config, "temp-"+aof.ManifestName(config.AppendFilename))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(m.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(path.Dir(final))
+	return nil
+}
+
+// openNewIncr starts the next incremental file, records it in the
+// manifest and makes it the file writes are appended to. The keyspace must
+// be locked.
+func openNewIncr(config *Config) error {
+	m := aofLog.manifest
+	seq := m.IncrSeq + 1
+	name := aof.IncrName(config.AppendFilename, seq)
+	f, err := os.OpenFile(aofPath(config, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	m.Incrs = append(m.Incrs, &aof.File{Name: name, Seq: seq, Type: aof.TypeIncr})
+	m.IncrSeq = seq
+	if err := persistManifest(config, m); err != nil {
+		m.Incrs = m.Incrs[:len(m.Incrs)-1]
+		m.IncrSeq--
+		f.Close()
+		os.Remove(aofPath(config, name))
+		return err
+	}
+	switchAOFFile(config, f)
+	return nil
+}
+
+// switchAOFFile makes writes go to f. The previous file is fsynced and
+// closed in the background.
+func switchAOFFile(config *Config, f *os.File) {
+	flushAppendOnlyFile(config)
+	if old := aofLog.file; old != nil {
+		go func() {
+			old.Sync()
+			old.Close()
+		}()
+	}
+	aofLog.file = f
+}
+
+func aofFilesSize(config *Config, m *aof.Manifest) int64 {
+	var size int64
+	for _, f := range m.Files() {
+		if fi, err := os.Stat(aofPath(config, f.Name)); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// ensureManifest loads the manifest of the AOF directory, or starts an
+// empty one, for a rewrite or for appendonly turned on at runtime. The
+// keyspace must be locked.
+func ensureManifest(config *Config) error {
+	if aofLog.manifest != nil {
+		return nil
+	}
+	if err := os.MkdirAll(path.Join(config.rdb_dir, config.AppendDirname), 0755); err != nil {
+		return err
+	}
+	m, err := aof.LoadManifest(aofPath(config, aof.ManifestName(config.AppendFilename)))
+	if errors.Is(err, fs.ErrNotExist) {
+		m, err = &aof.Manifest{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	aofLog.manifest = m
+	return nil
+}
+
+// startAppendOnly turns the AOF on at runtime. Writes are logged to a
+// temporary incremental file from now on, and a rewrite writes the dataset
+// as of now as the base; the two only replace the manifest's files once
+// the rewrite succeeded. The keyspace must be locked.
+func startAppendOnly(config *Config) error {
+	if err := ensureManifest(config); err != nil {
+		return err
+	}
+	abortAOFRewrite()
+	f, err := os.OpenFile(aofPath(config, tempIncrName(config)), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	aofLog.file = f
+	aofLog.waitRewrite = true
+	if err := startAOFRewrite(config); err != nil {
+		stopAppendOnly(config)
+		return err
+	}
+	return nil
+}
+
+// stopAppendOnly turns the AOF off at runtime, syncing what was written
+// and aborting a running rewrite. The keyspace must be locked.
+func stopAppendOnly(config *Config) {
+	flushAppendOnlyFile(config)
+	aofLog.file.Sync()
+	aofLog.file.Close()
+	if aofLog.waitRewrite {
+		os.Remove(aofPath(config, tempIncrName(config)))
+		aofLog.waitRewrite = false
+	}
+	aofLog.file = nil
+	aofLog.buf = nil
+	aofLog.lastWriteErr = nil
+	abortAOFRewrite()
+}
+
+func abortAOFRewrite() {
+	if aofLog.rewriteInProgress {
+		fmt.Println("Killing running AOF rewrite")
+		aofLog.rewriteInProgress = false
+		aofLog.rewriteGen++
+	}
+}
+
+// startAOFRewrite compacts the AOF into a new base file written from a
+// snapshot of the dataset. Writes move to a new incremental file at the
+// moment of the snapshot, so they carry on while the base is written from
+// a goroutine, and the new base plus that file hold the whole dataset.
+// The keyspace must be locked.
+func startAOFRewrite(config *Config) error {
+	if err := ensureManifest(config); err != nil {
+		fmt.Println("Can't rewrite append only file in background:", err)
+		return err
+	}
+	aofLog.rewriteIncrs = len(aofLog.manifest.Incrs)
+	if aofLog.file != nil && !aofLog.waitRewrite {
+		if err := openNewIncr(config); err != nil {
+			fmt.Println("Can't open new incr AOF:", err)
+			return err
+		}
+	}
+	entries := db.snapshot()
+	aofLog.rewriteGen++
+	gen := aofLog.rewriteGen
+	aofLog.rewriteInProgress = true
+	aofLog.rewriteStart = time.Now()
+	fmt.Println("Background append only file rewriting started")
+	go func() {
+		tmp := aofPath(config, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+		err := writeRewriteFile(tmp, entries)
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if gen != aofLog.rewriteGen {
+			os.Remove(tmp)
+			return
+		}
+		aofRewriteDone(config, tmp, err)
+	}()
+	return nil
+}
+
+// aofRewriteDone installs a finished rewrite written to tmp. The keyspace
+// must be locked.
+func aofRewriteDone(config *Config, tmp string, err error) {
+	aofLog.rewriteInProgress = false
+	aofLog.lastRewriteSeconds = int64(time.Since(aofLog.rewriteStart).Seconds())
+	if err == nil {
+		err = installAOFRewrite(config, tmp)
+	}
+	aofLog.lastRewriteOK = err == nil
+	if err != nil {
+		os.Remove(tmp)
+		fmt.Println("Background AOF rewrite failed:", err)
+		return
+	}
+	aofLog.rewrites++
+	fmt.Println("Background AOF rewrite finished successfully")
+}
+
+// installAOFRewrite makes tmp the new base. The old base and the
+// incremental files written before the snapshot become history and are
+// deleted once the new manifest is on disk. A failure leaves the manifest
+// as it was.
+func installAOFRewrite(config *Config, tmp string) error {
+	old := aofLog.manifest
+	m := &aof.Manifest{
+		History: append([]*aof.File(nil), old.History...),
+		Incrs:   append([]*aof.File(nil), old.Incrs[aofLog.rewriteIncrs:]...),
+		BaseSeq: old.BaseSeq + 1,
+		IncrSeq: old.IncrSeq,
+	}
+	m.Base = &aof.File{Name: aof.BaseName(config.AppendFilename, m.BaseSeq, true), Seq: m.BaseSeq, Type: aof.TypeBase}
+	if old.Base != nil {
+		m.History = append(m.History, &aof.File{Name: old.Base.Name, Seq: old.Base.Seq, Type: aof.TypeHistory})
+	}
+	for _, f := range old.Incrs[:aofLog.rewriteIncrs] {
+		m.History = append(m.History, &aof.File{Name: f.Name, Seq: f.Seq, Type: aof.TypeHistory})
+	}
+	base := aofPath(config, m.Base.Name)
+	if err := os.Rename(tmp, base); err != nil {
+		return err
+	}
+
+	// Writes since appendonly was turned on become the first incremental
+	// file of the new base.
+	var incr string
+	if aofLog.waitRewrite {
+		m.IncrSeq++
+		f := &aof.File{Name: aof.IncrName(config.AppendFilename, m.IncrSeq), Seq: m.IncrSeq, Type: aof.TypeIncr}
+		incr = aofPath(config, f.Name)
+		if err := os.Rename(aofPath(config, tempIncrName(config)), incr); err != nil {
+			os.Rename(base, tmp)
+			return err
+		}
+		m.Incrs = append(m.Incrs, f)
+	}
+	if err := persistManifest(config, m); err != nil {
+		os.Rename(base, tmp)
+		if incr != "" {
+			os.Rename(incr, aofPath(config, tempIncrName(config)))
+		}
+		return err
+	}
+	aofLog.manifest = m
+	aofLog.waitRewrite = false
+
+	for _, f := range m.History {
+		os.Remove(aofPath(config, f.Name))
+	}
+	m.History = nil
+	persistManifest(config, m)
+	aofLog.size = aofFilesSize(config, m)
+	aofLog.baseSize = aofLog.size
+	return nil
+}
+
+func handleBGRewriteAOF(conn net.Conn, parts []string, config *Config) {
+	if aofLog.rewriteInProgress {
+		conn.Write([]byte("-ERR Background append only file rewriting already in progress\r\n"))
+		return
+	}
+	if err := startAOFRewrite(config); err != nil {
+		conn.Write([]byte("-ERR Can't execute an AOF background rewriting. Please check the server logs for more information.\r\n"))
+		return
+	}
+	conn.Write([]byte("+Background append only file rewriting started\r\n"))
+}
+
+// discardConn swallows the replies of commands replayed from the AOF.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// loadAppendOnlyFiles replays the base and incremental files of m into
+// the keyspace, which must be locked.
+func loadAppendOnlyFiles(config *Config, m *aof.Manifest) {
+	start := time.Now()
+	db.masterLink = true
+	db.loading = true
+	defer func() { db.masterLink, db.loading = false, false }()
+	files := m.Files()
+	for i, f := range files {
+		loadAppendOnlyFile(config, aofPath(config, f.Name), i == len(files)-1)
+	}
+	rdbSave.dirtyAtLastSave = db.dirty
+	fmt.Printf("DB loaded from append only file: %.3f seconds\n", time.Since(start).Seconds())
+}
+
+// loadAppendOnlyFile replays one file of the AOF. The file may start with
+// an RDB preamble. A command cut short at the end of the last file, as
+// left by a crash mid-write, is dropped together with an unterminated
+// MULTI, and the file truncated to the last complete command, when
+// aof-load-truncated is on; any other damage stops the server.
+func loadAppendOnlyFile(config *Config, filename string, last bool) {
+	f, err := os.Open(filename)
+	if err != nil {
+		fmt.Println("Error opening the append only file:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	r := aof.NewReader(f)
+	if r.HasPreamble() {
+		if err := loadRDBFrom(r.RDB(), config); err != nil {
+			fmt.Printf("Error reading the RDB preamble of the AOF file %s: %v\n", filename, err)
+			os.Exit(1)
+		}
+	}
+
+	conn := discardConn{}
+	var queue [][]string
+	inMulti := false
+	var multiStart int64
+	for {
+		parts, err := r.Next()
+		if err == io.EOF && !inMulti {
+			return
+		}
+		if err == io.EOF || err == aof.ErrTruncated {
+			valid := r.Offset()
+			if inMulti {
+				valid = multiStart
+			}
+			truncateAppendOnlyFile(config, filename, valid, last)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Bad file format reading the append only file %s: %v\n", filename, err)
+			os.Exit(1)
+		}
+		name := strings.ToLower(parts[0])
+		switch {
+		case name == "select":
+			// Only database 0 exists here.
+			if len(parts) != 2 || parts[1] != "0" {
+				fmt.Printf("Can't load the append only file %s: database other than 0 selected\n", filename)
+				os.Exit(1)
+			}
+		case name == "multi":
+			inMulti = true
+			multiStart = r.Start()
+			queue = nil
+		case name == "exec":
+			for _, q := range queue {
+				replayCommand(conn, q, config)
+			}
+			inMulti = false
+			queue = nil
+		case lookupCommand(name) == nil:
+			fmt.Printf("Unknown command '%s' reading the append only file %s\n", parts[0], filename)
+			os.Exit(1)
+		case inMulti:
+			queue = append(queue, parts)
+		default:
+			replayCommand(conn, parts, config)
+		}
+	}
+}
+
+// truncateAppendOnlyFile handles a file that ends within a command: the
+// last file of the AOF is cut back to valid when aof-load-truncated is on,
+// anything else stops the server.
+func truncateAppendOnlyFile(config *Config, filename string, valid int64, last bool) {
+	if !last {
+		fmt.Printf("Unexpected end of file reading the append only file %s, which is not the last file of the AOF\n", filename)
+		os.Exit(1)
+	}
+	if !config.AOFLoadTruncated {
+		fmt.Printf("Unexpected end of file reading the append only file %s. You can: "+
+			"1) Make a backup of your AOF file, then use redis-check -fix <filename>. "+
+			"2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server.\n", filename)
+		os.Exit(1)
+	}
+	fmt.Printf("!!! Warning: short read while loading the AOF file %s!!!\n", filename)
+	fmt.Printf("!!! Truncating the AOF at offset %d !!!\n", valid)
+	if err := os.Truncate(filename, valid); err != nil {
+		fmt.Printf("Error truncating the AOF file %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	fmt.Println("AOF loaded anyway because aof-load-truncated is enabled")
+}
+
+// replayCommand runs a command read from the AOF. Commands with a wrong
+// number of arguments are skipped, as they would have failed when logged.
+func replayCommand(conn net.Conn, parts []string, config *Config) {
+	cmd, ok := checkCommand(conn, parts)
+	if !ok || cmd.handler == nil {
+		return
+	}
+	cmd.handler(conn, parts, config)
+}
+
+// aofInfo returns the AOF fields of INFO persistence.
+func aofInfo(config *Config) string {
+	inProgress, current := 0, int64(-1)
+	if aofLog.rewriteInProgress {
+		inProgress = 1
+		current = int64(time.Since(aofLog.rewriteStart).Seconds())
+	}
+	rewriteStatus, writeStatus := "ok", "ok"
+	if !aofLog.lastRewriteOK {
+		rewriteStatus = "err"
+	}
+	if aofLog.lastWriteErr != nil {
+		writeStatus = "err"
+	}
+	enabled := 0
+	if aofLog.file != nil {
+		enabled = 1
+	}
+	info := fmt.Sprintf(
+		"aof_enabled:%d\r\n"+
+			"aof_rewrite_in_progress:%d\r\n"+
+			"aof_last_rewrite_time_sec:%d\r\n"+
+			"aof_current_rewrite_time_sec:%d\r\n"+
+			"aof_last_bgrewrite_status:%s\r\n"+
+			"aof_rewrites:%d\r\n"+
+			"aof_last_write_status:%s\r\n",
+		enabled, inProgress, aofLog.lastRewriteSeconds, current,
+		rewriteStatus, aofLog.rewrites, writeStatus,
+	)
+	if enabled == 1 {
+		info += fmt.Sprintf("aof_current_size:%d\r\naof_base_size:%d\r\naof_buffer_length:%d\r\n",
+			aofLog.size, aofLog.baseSize, len(aofLog.buf))
+	}
+	return info
+}
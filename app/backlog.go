@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// minReplBacklogSize is the smallest repl-backlog-size accepted.
+const minReplBacklogSize = 16 * 1024
+
+// noReplicationID is the secondary replication ID while there is no
+// previous history.
+const noReplicationID = "0000000000000000000000000000000000000000"
+
+// replBacklog is a circular buffer holding the tail of the replication
+// stream, from which a replica that reconnects with a known replication ID
+// and offset can be sent what it missed instead of a full RDB. Offsets are
+// those of the stream: the first byte ever produced is at offset 1, and
+// master_repl_offset is the offset of the last one.
+type replBacklog struct {
+	buf []byte
+	// idx is where the next byte is written.
+	idx int
+	// histlen is the number of valid bytes, at most len(buf).
+	histlen int
+	// offset is the replication offset of the oldest byte held.
+	offset int64
+}
+
+// newReplBacklog creates an empty backlog whose next byte follows the
+// stream offset replOffset.
+func newReplBacklog(size int64, replOffset int64) *replBacklog {
+	return &replBacklog{buf: make([]byte, size), offset: replOffset + 1}
+}
+
+// write appends p to the backlog, dropping the oldest bytes once it is
+// full.
+func (b *replBacklog) write(p []byte) {
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % len(b.buf)
+		p = p[n:]
+		b.histlen += n
+		if b.histlen > len(b.buf) {
+			b.offset += int64(b.histlen - len(b.buf))
+			b.histlen = len(b.buf)
+		}
+	}
+}
+
+// covers reports whether the stream can be resumed from offset, which is
+// the one right after the last byte a replica holds.
+func (b *replBacklog) covers(offset int64) bool {
+	return offset >= b.offset && offset <= b.offset+int64(b.histlen)
+}
+
+// from returns a copy of the stream from offset to its end; offset must be
+// covered.
+func (b *replBacklog) from(offset int64) []byte {
+	skip := int(offset - b.offset)
+	out := make([]byte, 0, b.histlen-skip)
+	start := (b.idx - b.histlen + skip + len(b.buf)) % len(b.buf)
+	if start+b.histlen-skip <= len(b.buf) {
+		return append(out, b.buf[start:start+b.histlen-skip]...)
+	}
+	out = append(out, b.buf[start:]...)
+	return append(out, b.buf[:b.idx]...)
+}
+
+// resize changes the capacity of the backlog, keeping as much of the most
+// recent history as fits.
+func (b *replBacklog) resize(size int64) {
+	if int(size) == len(b.buf) {
+		return
+	}
+	end := b.offset + int64(b.histlen)
+	hist := b.from(b.offset)
+	if len(hist) > int(size) {
+		hist = hist[len(hist)-int(size):]
+	}
+	*b = replBacklog{buf: make([]byte, size), offset: end - int64(len(hist))}
+	b.write(hist)
+}
+
+// newReplicationID returns a random 40 characters replication ID.
+func newReplicationID() string {
+	var id [20]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// changeReplicationID starts a new replication history, which no replica
+// can resume from a previous one. ReplicaMu must be held.
+func changeReplicationID(config *Config) {
+	config.ReplID = newReplicationID()
+}
+
+// clearReplicationID2 forgets the previous replication history.
+// ReplicaMu must be held.
+func clearReplicationID2(config *Config) {
+	config.ReplID2 = noReplicationID
+	config.SecondReplOffset = -1
+}
+
+// shiftReplicationID moves to the history named newID while still
+// accepting partial resyncs against the current one up to the current
+// offset, as replicas of the same master share it. ReplicaMu must be held.
+func shiftReplicationID(config *Config, newID string) {
+	config.ReplID2 = config.ReplID
+	config.SecondReplOffset = config.ReplOffset + 1
+	config.ReplID = newID
+}
+
+// feedReplicationStream appends a payload to the replication stream: it
+// advances the offset, stores it in the backlog and queues it for the
+// replicas' writers, which send it to those still receiving their RDB once
+// the transfer is done. Nothing is produced while there is no backlog,
+// that is before the first replica attached. ReplicaMu must be held; it
+// returns the number of online replicas the payload was queued for.
+func feedReplicationStream(payload []byte, config *Config) int {
+	if config.backlog == nil {
+		return 0
+	}
+	config.ReplOffset += int64(len(payload))
+	config.backlog.write(payload)
+
+	sent := 0
+	for _, r := range config.replicas {
+		if r.state == replicaHandshake {
+			continue
+		}
+		r.buf = append(r.buf, payload...)
+		r.wake.Signal()
+		if r.state == replicaOnline {
+			sent++
+		}
+	}
+	return sent
+}
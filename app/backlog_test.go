@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// checkBacklog compares b with the last held bytes of stream, the whole
+// replication stream written so far starting at offset start.
+func checkBacklog(t *testing.T, b *replBacklog, stream []byte, start int64, held int) {
+	t.Helper()
+	end := start + int64(len(stream))
+	if b.histlen != held || b.offset != end-int64(held) {
+		t.Fatalf("holds %d bytes from offset %d, want %d from %d", b.histlen, b.offset, held, end-int64(held))
+	}
+	for off := b.offset; off <= end; off++ {
+		if !b.covers(off) {
+			t.Fatalf("offset %d not covered", off)
+		}
+		if got, want := b.from(off), stream[off-start:]; !bytes.Equal(got, want) {
+			t.Fatalf("from(%d) = %q, want %q", off, got, want)
+		}
+	}
+	if b.covers(b.offset-1) || b.covers(end+1) {
+		t.Fatalf("covers offsets outside [%d, %d]", b.offset, end)
+	}
+}
+
+func TestReplBacklogWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int64
+		writes []int
+	}{
+		{"empty", 8, nil},
+		{"partly filled", 8, []int{3, 2}},
+		{"exactly full", 8, []int{8}},
+		{"wraps", 8, []int{5, 5}},
+		{"ends on the wrap point", 8, []int{6, 2, 8}},
+		{"write larger than the buffer", 8, []int{3, 21}},
+		{"many small writes", 7, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const start = 101
+			b := newReplBacklog(tt.size, start-1)
+			var stream []byte
+			for _, n := range tt.writes {
+				p := make([]byte, n)
+				for i := range p {
+					p[i] = byte('a' + (len(stream)+i)%26)
+				}
+				b.write(p)
+				stream = append(stream, p...)
+				checkBacklog(t, b, stream, start, min(len(stream), int(tt.size)))
+			}
+			checkBacklog(t, b, stream, start, min(len(stream), int(tt.size)))
+		})
+	}
+}
+
+func TestReplBacklogResize(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int64
+		written int
+		resize  int64
+	}{
+		{"grow empty", 8, 0, 16},
+		{"grow partly filled", 8, 5, 16},
+		{"grow wrapped", 8, 13, 16},
+		{"shrink keeping everything", 16, 5, 8},
+		{"shrink dropping the oldest", 16, 13, 8},
+		{"shrink wrapped", 8, 21, 5},
+		{"same size", 8, 13, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const start = 1
+			b := newReplBacklog(tt.size, start-1)
+			stream := make([]byte, tt.written)
+			for i := range stream {
+				stream[i] = byte('A' + i%26)
+			}
+			b.write(stream)
+			b.resize(tt.resize)
+			if int64(len(b.buf)) != tt.resize {
+				t.Fatalf("size %d, want %d", len(b.buf), tt.resize)
+			}
+			// History dropped before the resize is not brought back.
+			held := min(tt.written, int(tt.size), int(tt.resize))
+			checkBacklog(t, b, stream, start, held)
+
+			// The backlog keeps working at its new size.
+			more := []byte("0123456789")
+			b.write(more)
+			checkBacklog(t, b, append(stream, more...), start, min(held+len(more), int(tt.resize)))
+		})
+	}
+}
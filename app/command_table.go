@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+type commandFlag int
+
+const (
+	cmdWrite commandFlag = 1 << iota
+	cmdReadonly
+	cmdBlocking
+	cmdAdmin
+	cmdPubsub
+	cmdLoading // allowed while the dataset is loading
+	cmdStale   // allowed on a replica with a broken master link
+)
+
+var commandFlagNames = []struct {
+	flag commandFlag
+	name string
+}{
+	{cmdWrite, "write"},
+	{cmdReadonly, "readonly"},
+	{cmdBlocking, "blocking"},
+	{cmdAdmin, "admin"},
+	{cmdPubsub, "pubsub"},
+	{cmdLoading, "loading"},
+	{cmdStale, "stale"},
+}
+
+// redisCommand describes a command the server understands. arity counts the
+// command name itself; a negative arity means "at least -arity arguments".
+// firstKey, lastKey and keyStep locate the key arguments the way COMMAND INFO
+// reports them (lastKey -1 means the last argument, 0 means no keys).
+type redisCommand struct {
+	name     string
+	arity    int
+	flags    commandFlag
+	firstKey int
+	lastKey  int
+	keyStep  int
+	group    string
+	summary  string
+	handler  func(conn net.Conn, parts []string, config *Config)
+}
+
+// commandTable is keyed by lower-case command name. MULTI, EXEC and DISCARD
+// have no handler: they change per-connection state and are dispatched by
+// handleConnection itself.
+var commandTable map[string]*redisCommand
+
+func init() {
+	commands := []*redisCommand{
+		{"ping", -1, 0, 0, 0, 0, "connection", "Returns the server's liveliness response.", handlePing},
+		{"echo", 2, 0, 0, 0, 0, "connection", "Returns the given string.", handleEcho},
+		{"set", -3, cmdWrite, 1, 1, 1, "string", "Sets the string value of a key.", handleSet},
+		{"get", 2, cmdReadonly, 1, 1, 1, "string", "Returns the string value of a key.", handleGet},
+		{"incr", 2, cmdWrite, 1, 1, 1, "string", "Increments the integer value of a key by one.", handleIncr},
+		{"incrbyfloat", 3, cmdWrite, 1, 1, 1, "string", "Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist.", handleIncrByFloat},
+		{"rpush", -3, cmdWrite, 1, 1, 1, "list", "Appends one or more elements to a list.", handleRPush},
+		{"lpush", -3, cmdWrite, 1, 1, 1, "list", "Prepends one or more elements to a list.", handleLPush},
+		{"lrange", 4, cmdReadonly, 1, 1, 1, "list", "Returns a range of elements from a list.", handleLRange},
+		{"llen", 2, cmdReadonly, 1, 1, 1, "list", "Returns the length of a list.", handleLLen},
+		{"lpop", -2, cmdWrite, 1, 1, 1, "list", "Returns the first elements in a list after removing it.", handleLPop},
+		{"blpop", -3, cmdWrite | cmdBlocking, 1, -2, 1, "list", "Removes and returns the first element in a list. Blocks until an element is available otherwise.", handleBLPop},
+		{"type", 2, cmdReadonly, 1, 1, 1, "generic", "Determines the type of value stored at a key.", handleType},
+		{"xadd", -5, cmdWrite, 1, 1, 1, "stream", "Appends a new message to a stream.", handleXAdd},
+		{"xrange", 4, cmdReadonly, 1, 1, 1, "stream", "Returns the messages from a stream within a range of IDs.", handleXRange},
+		{"xread", -4, cmdReadonly | cmdBlocking, 0, 0, 0, "stream", "Returns messages from multiple streams with IDs greater than the ones requested.", handleXRead},
+		{"del", -2, cmdWrite, 1, -1, 1, "generic", "Deletes one or more keys.", handleDel},
+		{"unlink", -2, cmdWrite, 1, -1, 1, "generic", "Asynchronously deletes one or more keys.", handleUnlink},
+		{"exists", -2, cmdReadonly, 1, -1, 1, "generic", "Determines whether one or more keys exist.", handleExists},
+		{"touch", -2, cmdReadonly, 1, -1, 1, "generic", "Returns the number of existing keys out of those specified after updating the time they were last accessed.", handleTouch},
+		{"rename", 3, cmdWrite, 1, 2, 1, "generic", "Renames a key and overwrites the destination.", handleRename},
+		{"renamenx", 3, cmdWrite, 1, 2, 1, "generic", "Renames a key only when the target key name doesn't exist.", handleRenameNX},
+		{"copy", -3, cmdWrite, 1, 2, 1, "generic", "Copies the value of a key to a new key.", handleCopy},
+		{"expire", -3, cmdWrite, 1, 1, 1, "generic", "Sets the expiration time of a key in seconds.", handleExpire},
+		{"pexpire", -3, cmdWrite, 1, 1, 1, "generic", "Sets the expiration time of a key in milliseconds.", handlePExpire},
+		{"expireat", -3, cmdWrite, 1, 1, 1, "generic", "Sets the expiration time of a key to a Unix timestamp.", handleExpireAt},
+		{"pexpireat", -3, cmdWrite, 1, 1, 1, "generic", "Sets the expiration time of a key to a Unix milliseconds timestamp.", handlePExpireAt},
+		{"ttl", 2, cmdReadonly, 1, 1, 1, "generic", "Returns the expiration time in seconds of a key.", handleTTL},
+		{"pttl", 2, cmdReadonly, 1, 1, 1, "generic", "Returns the expiration time in milliseconds of a key.", handlePTTL},
+		{"expiretime", 2, cmdReadonly, 1, 1, 1, "generic", "Returns the expiration time of a key as a Unix timestamp.", handleExpireTime},
+		{"pexpiretime", 2, cmdReadonly, 1, 1, 1, "generic", "Returns the expiration time of a key as a Unix milliseconds timestamp.", handlePExpireTime},
+		{"persist", 2, cmdWrite, 1, 1, 1, "generic", "Removes the expiration time of a key.", handlePersist},
+		{"randomkey", 1, cmdReadonly, 0, 0, 0, "generic", "Returns a random key name from the database.", handleRandomKey},
+		{"dbsize", 1, cmdReadonly, 0, 0, 0, "server", "Returns the number of keys in the database.", handleDBSize},
+		{"flushdb", -1, cmdWrite, 0, 0, 0, "server", "Removes all keys from the current database.", handleFlushAll},
+		{"flushall", -1, cmdWrite, 0, 0, 0, "server", "Removes all keys from all databases.", handleFlushAll},
+		{"keys", 2, cmdReadonly, 0, 0, 0, "generic", "Returns all key names that match a pattern.", handleKeys},
+		{"scan", -2, cmdReadonly, 0, 0, 0, "generic", "Iterates over the key names in the database.", handleScan},
+		{"hscan", -3, cmdReadonly, 1, 1, 1, "hash", "Iterates over fields and values of a hash.", handleHScan},
+		{"sscan", -3, cmdReadonly, 1, 1, 1, "set", "Iterates over members of a set.", handleSScan},
+		{"zscan", -3, cmdReadonly, 1, 1, 1, "sorted-set", "Iterates over members and scores of a sorted set.", handleZScan},
+		{"save", 1, cmdAdmin, 0, 0, 0, "server", "Synchronously saves the database(s) to disk.", handleSave},
+		{"bgsave", -1, cmdAdmin, 0, 0, 0, "server", "Asynchronously saves the database(s) to disk.", handleBGSave},
+		{"bgrewriteaof", 1, cmdAdmin, 0, 0, 0, "server", "Asynchronously rewrites the append-only file to disk.", handleBGRewriteAOF},
+		{"lastsave", 1, cmdLoading | cmdStale, 0, 0, 0, "server", "Returns the Unix timestamp of the last successful save to disk.", handleLastSave},
+		{"info", -1, cmdLoading | cmdStale, 0, 0, 0, "server", "Returns information and statistics about the server.", handleInfo},
+		{"config", -2, cmdAdmin | cmdLoading | cmdStale, 0, 0, 0, "server", "Gets or sets configuration parameters.", handleConfig},
+		{"command", -1, cmdLoading | cmdStale, 0, 0, 0, "server", "Returns detailed information about commands.", handleCommandCommand},
+		{"wait", 3, 0, 0, 0, 0, "generic", "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed.", handleWait},
+		{"replconf", -1, cmdAdmin | cmdLoading | cmdStale, 0, 0, 0, "server", "An internal command for configuring the replication stream.", hadleReplconf},
+		{"replicaof", 3, cmdAdmin | cmdStale, 0, 0, 0, "server", "Configures a server as replica of another, or promotes it to a master.", handleReplicaOf},
+		{"slaveof", 3, cmdAdmin | cmdStale, 0, 0, 0, "server", "Sets a Redis server as a replica of another, or promotes it to being a master.", handleReplicaOf},
+		{"psync", -3, cmdAdmin, 0, 0, 0, "server", "An internal command used in replication.", handlePsync},
+		{"multi", 1, cmdLoading | cmdStale, 0, 0, 0, "transactions", "Starts a transaction.", nil},
+		{"exec", 1, cmdLoading | cmdStale, 0, 0, 0, "transactions", "Executes all commands in a transaction.", nil},
+		{"discard", 1, cmdLoading | cmdStale, 0, 0, 0, "transactions", "Discards a transaction.", nil},
+	}
+	commandTable = make(map[string]*redisCommand, len(commands))
+	for _, c := range commands {
+		commandTable[c.name] = c
+	}
+}
+
+func lookupCommand(name string) *redisCommand {
+	return commandTable[strings.ToLower(name)]
+}
+
+func (c *redisCommand) arityOK(argc int) bool {
+	if c.arity < 0 {
+		return argc >= -c.arity
+	}
+	return argc == c.arity
+}
+
+func (c *redisCommand) flagNames() []string {
+	var names []string
+	for _, f := range commandFlagNames {
+		if c.flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// keys returns the key arguments of parts according to the key positions in
+// the table.
+func (c *redisCommand) keys(parts []string) []string {
+	if c.firstKey == 0 {
+		return nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last += len(parts)
+	}
+	var keys []string
+	for i := c.firstKey; i <= last && i < len(parts); i += c.keyStep {
+		keys = append(keys, parts[i])
+	}
+	return keys
+}
+
+// checkCommand validates the name and arity of a request and writes the
+// error reply if it is not runnable.
+func checkCommand(conn net.Conn, parts []string) (*redisCommand, bool) {
+	cmd := lookupCommand(parts[0])
+	if cmd == nil {
+		var args strings.Builder
+		for _, a := range parts[1:] {
+			fmt.Fprintf(&args, "'%s' ", a)
+		}
+		fmt.Fprintf(conn, "-ERR unknown command '%s', with args beginning with: %s\r\n", parts[0], args.String())
+		return nil, false
+	}
+	if !cmd.arityOK(len(parts)) {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for '%s' command\r\n", cmd.name)
+		return nil, false
+	}
+	return cmd, true
+}
+
+func handleCommandCommand(conn net.Conn, parts []string, config *Config) {
+	if len(parts) == 1 {
+		writeCommandInfos(conn, sortedCommands())
+		return
+	}
+	switch strings.ToUpper(parts[1]) {
+	case "COUNT":
+		fmt.Fprintf(conn, ":%d\r\n", len(commandTable))
+	case "LIST":
+		var names []string
+		for _, c := range sortedCommands() {
+			names = append(names, c.name)
+		}
+		conn.Write(encodeArray(names))
+	case "INFO":
+		cmds := sortedCommands()
+		if len(parts) > 2 {
+			cmds = cmds[:0]
+			for _, name := range parts[2:] {
+				cmds = append(cmds, lookupCommand(name))
+			}
+		}
+		writeCommandInfos(conn, cmds)
+	case "GETKEYS":
+		if len(parts) < 3 {
+			conn.Write([]byte("-ERR wrong number of arguments for 'command|getkeys' command\r\n"))
+			return
+		}
+		c := lookupCommand(parts[2])
+		if c == nil {
+			conn.Write([]byte("-ERR Invalid command specified\r\n"))
+			return
+		}
+		if !c.arityOK(len(parts) - 2) {
+			conn.Write([]byte("-ERR Invalid number of arguments specified for command\r\n"))
+			return
+		}
+		keys := c.keys(parts[2:])
+		if len(keys) == 0 {
+			conn.Write([]byte("-ERR The command has no key arguments\r\n"))
+			return
+		}
+		conn.Write(encodeArray(keys))
+	case "DOCS":
+		cmds := sortedCommands()
+		if len(parts) > 2 {
+			cmds = cmds[:0]
+			for _, name := range parts[2:] {
+				if c := lookupCommand(name); c != nil {
+					cmds = append(cmds, c)
+				}
+			}
+		}
+		var resp strings.Builder
+		fmt.Fprintf(&resp, "*%d\r\n", len(cmds)*2)
+		for _, c := range cmds {
+			fmt.Fprintf(&resp, "$%d\r\n%s\r\n", len(c.name), c.name)
+			resp.Write(encodeArray([]string{"summary", c.summary, "group", c.group}))
+		}
+		conn.Write([]byte(resp.String()))
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'. Try COMMAND HELP.\r\n", parts[1])
+	}
+}
+
+func sortedCommands() []*redisCommand {
+	cmds := make([]*redisCommand, 0, len(commandTable))
+	for _, c := range commandTable {
+		cmds = append(cmds, c)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+	return cmds
+}
+
+// writeCommandInfos writes the COMMAND INFO reply; unknown commands (nil)
+// are reported as null entries.
+func writeCommandInfos(conn net.Conn, cmds []*redisCommand) {
+	var resp strings.Builder
+	fmt.Fprintf(&resp, "*%d\r\n", len(cmds))
+	for _, c := range cmds {
+		if c == nil {
+			resp.WriteString("*-1\r\n")
+			continue
+		}
+		resp.WriteString("*10\r\n")
+		fmt.Fprintf(&resp, "$%d\r\n%s\r\n", len(c.name), c.name)
+		fmt.Fprintf(&resp, ":%d\r\n", c.arity)
+		flags := c.flagNames()
+		fmt.Fprintf(&resp, "*%d\r\n", len(flags))
+		for _, f := range flags {
+			fmt.Fprintf(&resp, "+%s\r\n", f)
+		}
+		fmt.Fprintf(&resp, ":%d\r\n:%d\r\n:%d\r\n", c.firstKey, c.lastKey, c.keyStep)
+		// ACL categories, tips, key specs and subcommands are not tracked.
+		resp.WriteString("*0\r\n*0\r\n*0\r\n*0\r\n")
+	}
+	conn.Write([]byte(resp.String()))
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -26,56 +26,19 @@ func parseStreamID(id string) (ms int64, seq int64, err error) {
 	return ms, seq, nil
 }
 
-func getListLock(key string) *sync.Mutex {
-	listLocksMu.Lock()
-	defer listLocksMu.Unlock()
-	if l, ok := listLocks[key]; ok {
-		return l
+func readCommand(reader *bufio.Reader, conn net.Conn, config *Config) ([]string, error) {
+	parts, _, err := readRequest(reader, config.ProtoMaxBulkLen)
+	if perr, ok := err.(*protocolError); ok {
+		conn.Write([]byte("-ERR " + perr.Error() + "\r\n"))
 	}
-	l := &sync.Mutex{}
-	listLocks[key] = l
-	return l
+	return parts, err
 }
 
-func readCommand(reader *bufio.Reader, conn net.Conn) ([]string, error) {
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
-	line = strings.TrimSpace(line)
-	if !strings.HasPrefix(line, "*") {
-		conn.Write([]byte("-ERR Protocol error\r\n"))
-		return nil, fmt.Errorf("protocol error")
-	}
-
-	numElems, err := strconv.Atoi(line[1:])
-	if err != nil {
-		conn.Write([]byte("-ERR invalid multibulk length\r\n"))
-		return nil, err
-	}
-
-	var parts []string
-	for i := 0; i < numElems; i++ {
-		_, err := reader.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-		arg, err := reader.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-		parts = append(parts, strings.TrimSpace(arg))
-	}
-	return parts, nil
+func handlePing(conn net.Conn, parts []string, config *Config) {
+	conn.Write([]byte("+PONG\r\n"))
 }
 
-func handlePing(conn net.Conn, config *Config) {
-	if config.Role == "master" {
-		conn.Write([]byte("+PONG\r\n"))
-	}
-}
-
-func handleEcho(conn net.Conn, parts []string) {
+func handleEcho(conn net.Conn, parts []string, config *Config) {
 	if len(parts) > 1 {
 		msg := parts[1]
 		conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(msg), msg)))
@@ -85,75 +48,113 @@ func handleEcho(conn net.Conn, parts []string) {
 }
 
 func handleSet(conn net.Conn, parts []string, config *Config) {
-	if len(parts) < 3 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'SET'\r\n"))
-		return
-	}
 	key := parts[1]
 	value := parts[2]
 	expiry := time.Time{} // No expiry by default
-	if len(parts) > 4 && strings.ToUpper(parts[3]) == "PX" {
-		expiryMs, err := strconv.Atoi(parts[4])
-		if err != nil {
-			conn.Write([]byte("-ERR invalid expiry value\r\n"))
+	var nx, xx, get, keepTTL, hasExpiry bool
+	for i := 3; i < len(parts); i++ {
+		opt := strings.ToUpper(parts[i])
+		switch {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case opt == "GET":
+			get = true
+		case opt == "KEEPTTL" && !hasExpiry:
+			keepTTL = true
+		case (opt == "EX" || opt == "PX" || opt == "EXAT" || opt == "PXAT") && !keepTTL && !hasExpiry && i+1 < len(parts):
+			n, err := strconv.ParseInt(parts[i+1], 10, 64)
+			if err != nil {
+				conn.Write([]byte("-ERR value is not an integer or out of range\r\n"))
+				return
+			}
+			unit := time.Second
+			if opt == "PX" || opt == "PXAT" {
+				unit = time.Millisecond
+			}
+			var ok bool
+			expiry, ok = expireDeadline(n, unit, strings.HasSuffix(opt, "AT"))
+			if n <= 0 || !ok {
+				conn.Write([]byte("-ERR invalid expire time in 'set' command\r\n"))
+				return
+			}
+			hasExpiry = true
+			i++
+		default:
+			conn.Write([]byte("-ERR syntax error\r\n"))
 			return
 		}
-		expiry = time.Now().Add(time.Duration(expiryMs) * time.Millisecond)
 	}
 
-	mu.Lock()
-	store[key] = Entry{Value: value, Expiry: expiry}
-	mu.Unlock()
-	if config.Role == "master" {
-		conn.Write([]byte("+OK\r\n"))
+	old := db.lookup(key)
+	if get && !checkType(conn, old, typeString) {
+		return
 	}
-}
-
-func handleGet(conn net.Conn, parts []string) {
-	if len(parts) < 2 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'GET'\r\n"))
+	// With GET the reply is the old value whether or not the SET happens.
+	reply := "+OK\r\n"
+	if get {
+		reply = "$-1\r\n"
+		if old != nil {
+			oldValue := old.value.(string)
+			reply = fmt.Sprintf("$%d\r\n%s\r\n", len(oldValue), oldValue)
+		}
+	}
+	if (nx && old != nil) || (xx && old == nil) {
+		if !get {
+			reply = "$-1\r\n"
+		}
+		conn.Write([]byte(reply))
 		return
 	}
-	key := parts[1]
-	mu.RLock()
-	entry, exists := store[key]
-	mu.RUnlock()
 
-	if !exists || (entry.Expiry.After(time.Time{}) && time.Now().After(entry.Expiry)) {
+	obj := newStringObject(value)
+	if keepTTL && old != nil {
+		expiry = old.expiry
+	}
+	obj.expiry = expiry
+	db.set(key, obj)
+	db.dirty++
+	if hasExpiry {
+		// The deadline is propagated as absolute, so replicas and the AOF
+		// do not count it from the time they apply the command.
+		db.rewrite = []string{"SET", key, value, "PXAT", strconv.FormatInt(expiry.UnixMilli(), 10)}
+	}
+	conn.Write([]byte(reply))
+}
+
+func handleGet(conn net.Conn, parts []string, config *Config) {
+	obj := db.lookup(parts[1])
+	if obj == nil {
 		conn.Write([]byte("$-1\r\n")) // Null bulk string
-		if exists && entry.Expiry.After(time.Time{}) && time.Now().After(entry.Expiry) {
-			mu.Lock()
-			delete(store, key)
-			mu.Unlock()
-		}
 		return
 	}
-	conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(entry.Value), entry.Value)))
+	if !checkType(conn, obj, typeString) {
+		return
+	}
+	value := obj.value.(string)
+	conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)))
 }
 
 func handleRPush(conn net.Conn, parts []string, config *Config) {
-	if len(parts) < 3 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'RPUSH'\r\n"))
-		return
-	}
 	key := parts[1]
 	values := parts[2:]
 
-	listLock := getListLock(key)
-	listLock.Lock()
-	defer listLock.Unlock()
-
-	list_store[key] = append(list_store[key], values...)
-	if config.Role == "master" {
-		fmt.Fprintf(conn, ":%d\r\n", len(list_store[key]))
+	obj := db.lookup(key)
+	if !checkType(conn, obj, typeList) {
+		return
+	}
+	if obj == nil {
+		obj = newListObject()
+		db.set(key, obj)
 	}
+	list := append(obj.value.([]string), values...)
+	obj.value = list
+	db.dirty += int64(len(values))
+	fmt.Fprintf(conn, ":%d\r\n", len(list))
 }
 
-func handleLRange(conn net.Conn, parts []string) {
-	if len(parts) < 3 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'LRANGE'\r\n"))
-		return
-	}
+func handleLRange(conn net.Conn, parts []string, config *Config) {
 	key := parts[1]
 	start, err := strconv.Atoi(parts[2])
 	if err != nil {
@@ -166,15 +167,15 @@ func handleLRange(conn net.Conn, parts []string) {
 		return
 	}
 
-	listLock := getListLock(key)
-	listLock.Lock()
-	defer listLock.Unlock()
-
-	values, ok := list_store[key]
-	if !ok {
+	obj := db.lookup(key)
+	if obj == nil {
 		conn.Write([]byte("*0\r\n"))
 		return
 	}
+	if !checkType(conn, obj, typeList) {
+		return
+	}
+	values := obj.value.([]string)
 	if start < 0 && end < 0 {
 		start += len(values)
 		end += len(values)
@@ -206,43 +207,39 @@ func handleLRange(conn net.Conn, parts []string) {
 }
 
 func handleLPush(conn net.Conn, parts []string, config *Config) {
-	if len(parts) < 3 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'LPUSH'\r\n"))
-		return
-	}
 	key := parts[1]
 	values := parts[2:]
-	listLock := getListLock(key)
-	listLock.Lock()
-	defer listLock.Unlock()
-	for i := 0; i < len(values); i++ {
-		list_store[key] = append([]string{values[i]}, list_store[key]...)
+
+	obj := db.lookup(key)
+	if !checkType(conn, obj, typeList) {
+		return
 	}
-	if config.Role == "master" {
-		fmt.Fprintf(conn, ":%d\r\n", len(list_store[key]))
+	if obj == nil {
+		obj = newListObject()
+		db.set(key, obj)
 	}
+	list := obj.value.([]string)
+	for i := 0; i < len(values); i++ {
+		list = append([]string{values[i]}, list...)
+	}
+	obj.value = list
+	db.dirty += int64(len(values))
+	fmt.Fprintf(conn, ":%d\r\n", len(list))
 }
 
-func handleLLen(conn net.Conn, parts []string) {
-	if len(parts) < 2 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'LLEN'\r\n"))
+func handleLLen(conn net.Conn, parts []string, config *Config) {
+	obj := db.lookup(parts[1])
+	if !checkType(conn, obj, typeList) {
 		return
 	}
-	key := parts[1]
-
-	listLock := getListLock(key)
-	listLock.Lock()
-	defer listLock.Unlock()
-
-	length := len(list_store[key])
+	length := 0
+	if obj != nil {
+		length = len(obj.value.([]string))
+	}
 	fmt.Fprintf(conn, ":%d\r\n", length)
 }
 
-func handleLPop(conn net.Conn, parts []string) {
-	if len(parts) < 2 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'LPOP'\r\n"))
-		return
-	}
+func handleLPop(conn net.Conn, parts []string, config *Config) {
 	key := parts[1]
 	turns := 1
 	if len(parts) > 2 {
@@ -253,118 +250,96 @@ func handleLPop(conn net.Conn, parts []string) {
 			return
 		}
 	}
-	listLock := getListLock(key)
-	listLock.Lock()
-	defer listLock.Unlock()
-
-	values, ok := list_store[key]
-	if !ok || len(values) == 0 || turns > len(values) {
+	obj := db.lookup(key)
+	if !checkType(conn, obj, typeList) {
+		return
+	}
+	var values []string
+	if obj != nil {
+		values = obj.value.([]string)
+	}
+	if len(values) == 0 || turns > len(values) {
 		conn.Write([]byte("$-1\r\n")) // Null bulk string
 		return
 	}
 
 	if turns == 1 {
 		value := values[0]
-		list_store[key] = values[1:]
+		obj.value = values[1:]
+		db.dirty++
 		conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)))
-		if len(list_store[key]) == 0 {
-			delete(list_store, key)
+		if len(values) == 1 {
+			db.delete(key)
 		}
 		return
 	}
 
-	conn.Write([]byte(fmt.Sprintf("*%d\r\n", turns)))
+	var resp strings.Builder
+	resp.WriteString(fmt.Sprintf("*%d\r\n", turns))
 	for i := 0; i < turns && len(values) > 0; i++ {
 		value := values[0]
 		values = values[1:]
-		conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)))
+		resp.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
 	}
-	list_store[key] = values
+	conn.Write([]byte(resp.String()))
+	obj.value = values
+	db.dirty += int64(turns)
 	if len(values) == 0 {
-		delete(list_store, key)
+		db.delete(key)
 	}
 }
 
-func handleBLPop(conn net.Conn, parts []string) {
-	if len(parts) < 2 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'BLPOP'\r\n"))
+func handleBLPop(conn net.Conn, parts []string, config *Config) {
+	keys := parts[1 : len(parts)-1]
+	timeout, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil || timeout < 0 {
+		conn.Write([]byte("-ERR timeout is not a float or out of range\r\n"))
 		return
 	}
-	key := parts[1]
-	timeout := -1.0
-	if len(parts) > 2 {
-		var err error
-		timeout, err = strconv.ParseFloat(parts[2], 64)
-
-		if err != nil || timeout < 0 {
-			conn.Write([]byte("-ERR invalid timeout value\r\n"))
-			return
-		}
-	}
 
 	start := time.Now()
 	for {
-		listLock := getListLock(key)
-		listLock.Lock()
-		values, ok := list_store[key]
-		if ok && len(values) > 0 {
-			if timeout > 0 {
-				time.Sleep(time.Duration(timeout) * time.Millisecond)
+		for _, key := range keys {
+			obj := db.lookup(key)
+			if !checkType(conn, obj, typeList) {
+				return
 			}
+			if obj == nil {
+				continue
+			}
+			values := obj.value.([]string)
 			value := values[0]
-			list_store[key] = values[1:]
-			listLock.Unlock()
-			// RESP array: [key, value]
-			fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(value), value)
-			if len(list_store[key]) == 0 {
+			obj.value = values[1:]
+			db.dirty++
+			if len(values) == 1 {
 				// Clean up empty list
-				listLock.Lock()
-				delete(list_store, key)
-				listLock.Unlock()
+				db.delete(key)
 			}
+			// Replicas pop from the list that was served, without waiting.
+			db.rewrite = []string{"LPOP", key}
+			// RESP array: [key, value]
+			fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(value), value)
 			return
 		}
-		listLock.Unlock()
 
 		if timeout > 0 && time.Since(start) >= time.Duration(timeout*float64(time.Second)) {
 			conn.Write([]byte("$-1\r\n"))
 			return
 		}
-		time.Sleep(10 * time.Millisecond)
+		if !db.sleepUnlocked(10 * time.Millisecond) {
+			conn.Write([]byte("$-1\r\n"))
+			return
+		}
 	}
 }
 
-func handleType(conn net.Conn, parts []string) {
-	if len(parts) < 2 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'TYPE'\r\n"))
-		return
-	}
-	key := parts[1]
-	streamsMu.RLock()
-	_, isStream := streams[key]
-	streamsMu.RUnlock()
-	if isStream {
-		conn.Write([]byte("+stream\r\n"))
+func handleType(conn net.Conn, parts []string, config *Config) {
+	obj := db.lookup(parts[1])
+	if obj == nil {
+		conn.Write([]byte("+none\r\n"))
 		return
 	}
-	mu.RLock()
-	entry, exists := store[key]
-	mu.RUnlock()
-
-	if !exists {
-		conn.Write([]byte(fmt.Sprintf("$4\r\n%s\r\n", "none")))
-		return
-	}
-
-	if entry.Expiry.After(time.Time{}) && time.Now().After(entry.Expiry) {
-		mu.Lock()
-		delete(store, key)
-		mu.Unlock()
-		conn.Write([]byte(fmt.Sprintf("$4\r\n%s\r\n", "none")))
-		return
-	}
-
-	conn.Write([]byte(fmt.Sprintf("$6\r\n%s\r\n", "string")))
+	fmt.Fprintf(conn, "+%s\r\n", obj.typ)
 }
 
 func handleXAdd(conn net.Conn, parts []string, config *Config) {
@@ -379,6 +354,15 @@ func handleXAdd(conn net.Conn, parts []string, config *Config) {
 		fields[parts[i]] = parts[i+1]
 	}
 
+	obj := db.lookup(key)
+	if !checkType(conn, obj, typeStream) {
+		return
+	}
+	if obj == nil {
+		obj = newStreamObject()
+	}
+	entries := obj.value.([]StreamEntry)
+
 	if strings.HasSuffix(id, "-*") || id == "*" {
 		ms := time.Now().UnixMilli()
 		if id != "*" {
@@ -390,9 +374,19 @@ func handleXAdd(conn net.Conn, parts []string, config *Config) {
 			}
 			ms = ms_
 		}
+		// IDs only grow: "*" never goes below the top item, even if the
+		// clock does, and so replicas given the ID accept it.
+		if len(entries) > 0 {
+			lastMs, _, err := parseStreamID(entries[len(entries)-1].ID)
+			if err == nil && ms < lastMs {
+				if id != "*" {
+					conn.Write([]byte("-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"))
+					return
+				}
+				ms = lastMs
+			}
+		}
 		seq := int64(0)
-		streamsMu.Lock()
-		entries := streams[key]
 		for _, entry := range entries {
 			entryMs, entrySeq, err := parseStreamID(entry.ID)
 			if err == nil && entryMs == ms && entrySeq >= seq {
@@ -403,11 +397,13 @@ func handleXAdd(conn net.Conn, parts []string, config *Config) {
 			seq = 1
 		}
 		id = fmt.Sprintf("%d-%d", ms, seq)
-		streams[key] = append(streams[key], StreamEntry{ID: id, Fields: fields})
-		streamsMu.Unlock()
-		if config.Role == "master" {
-			conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(id), id)))
-		}
+		obj.value = append(entries, StreamEntry{ID: id, Fields: fields})
+		db.set(key, obj)
+		db.dirty++
+		// Propagate the ID that was generated rather than the request for
+		// one, which would depend on the clock and the stream elsewhere.
+		db.rewrite = append([]string{"XADD", key, id}, parts[3:]...)
+		conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(id), id)))
 		return
 	}
 
@@ -422,9 +418,6 @@ func handleXAdd(conn net.Conn, parts []string, config *Config) {
 		return
 	}
 
-	streamsMu.Lock()
-	defer streamsMu.Unlock()
-	entries := streams[key]
 	if len(entries) > 0 {
 		last := entries[len(entries)-1]
 		lastMs, lastSeq, err := parseStreamID(last.ID)
@@ -437,15 +430,13 @@ func handleXAdd(conn net.Conn, parts []string, config *Config) {
 			return
 		}
 	}
-	streams[key] = append(streams[key], StreamEntry{ID: id, Fields: fields})
+	obj.value = append(entries, StreamEntry{ID: id, Fields: fields})
+	db.set(key, obj)
+	db.dirty++
 	conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(id), id)))
 }
 
-func handleXRange(conn net.Conn, parts []string) {
-	if len(parts) != 4 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'XRANGE'\r\n"))
-		return
-	}
+func handleXRange(conn net.Conn, parts []string, config *Config) {
 	key := parts[1]
 	startID := parts[2]
 	if startID == "-" {
@@ -457,13 +448,15 @@ func handleXRange(conn net.Conn, parts []string) {
 		endID = maxId + "-" + maxId
 	}
 
-	streamsMu.RLock()
-	entries, ok := streams[key]
-	streamsMu.RUnlock()
-	if !ok || len(entries) == 0 {
+	obj := db.lookup(key)
+	if !checkType(conn, obj, typeStream) {
+		return
+	}
+	if obj == nil {
 		conn.Write([]byte("*0\r\n"))
 		return
 	}
+	entries := obj.value.([]StreamEntry)
 
 	// Parse start and end IDs, defaulting sequence part if missing
 	parseID := func(id string, isStart bool) (int64, int64, error) {
@@ -525,7 +518,7 @@ func handleXRange(conn net.Conn, parts []string) {
 	conn.Write([]byte(resp.String()))
 }
 
-func handleXRead(conn net.Conn, part []string) {
+func handleXRead(conn net.Conn, part []string, config *Config) {
 	if len(part) < 3 {
 		conn.Write([]byte("-ERR wrong number of arguments for 'XREAD'\r\n"))
 		return
@@ -536,6 +529,7 @@ func handleXRead(conn net.Conn, part []string) {
 	}
 
 	blockMs := 0
+	blocking := false
 	streamIdx := 2
 	if len(part) > 4 && strings.ToUpper(part[1]) == "BLOCK" {
 		b, err := strconv.Atoi(part[2])
@@ -544,12 +538,30 @@ func handleXRead(conn net.Conn, part []string) {
 			return
 		}
 		blockMs = b
+		blocking = true
 		streamIdx = 4
 	}
 
 	streamCount := (len(part) - streamIdx) / 2
 	keys := part[streamIdx : streamIdx+streamCount]
-	ids := part[streamIdx+streamCount:]
+	ids := append([]string(nil), part[streamIdx+streamCount:]...)
+
+	// "$" means entries added after this call, so pin it to the current top.
+	for i, key := range keys {
+		obj := db.lookup(key)
+		if !checkType(conn, obj, typeStream) {
+			return
+		}
+		if ids[i] != "$" {
+			continue
+		}
+		ids[i] = "0-0"
+		if obj != nil {
+			if entries := obj.value.([]StreamEntry); len(entries) > 0 {
+				ids[i] = entries[len(entries)-1].ID
+			}
+		}
+	}
 
 	start := time.Now()
 	for {
@@ -557,50 +569,32 @@ func handleXRead(conn net.Conn, part []string) {
 		foundAny := false
 		resp.WriteString(fmt.Sprintf("*%d\r\n", len(keys)))
 		for i, key := range keys {
-			streamsMu.RLock()
-			entries, ok := streams[key]
-			streamsMu.RUnlock()
-			if !ok || len(entries) == 0 {
+			var entries []StreamEntry
+			obj := db.lookup(key)
+			if obj != nil && obj.typ == typeStream {
+				entries = obj.value.([]StreamEntry)
+			}
+			if len(entries) == 0 {
 				resp.WriteString(fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*0\r\n", len(key), key))
 				continue
 			}
 			var matching []StreamEntry
-			if ids[i] == "$" {
-				lastIdx := len(entries) - 1
-				for {
-					streamsMu.RLock()
-					entries, ok = streams[key]
-					streamsMu.RUnlock()
-
-					if ok && len(entries)-1 > lastIdx {
-						matching = append(matching, entries[lastIdx+1:]...)
-						foundAny = true
-						break
-					}
-					if blockMs > 0 && time.Since(start) >= time.Duration(blockMs)*time.Millisecond {
-						conn.Write([]byte("$-1\r\n"))
-						return
-					}
-					time.Sleep(10 * time.Millisecond)
-				}
-			} else {
-				ms, sq, err := parseStreamID(ids[i])
+			ms, sq, err := parseStreamID(ids[i])
+			if err != nil {
+				conn.Write([]byte("-ERR invalid stream ID format\r\n"))
+				return
+			}
+			found := false
+			for _, entry := range entries {
+				entryMs, entrySeq, err := parseStreamID(entry.ID)
 				if err != nil {
-					conn.Write([]byte("-ERR invalid stream ID format\r\n"))
-					return
+					continue
 				}
-				found := false
-				for _, entry := range entries {
-					entryMs, entrySeq, err := parseStreamID(entry.ID)
-					if err != nil {
-						continue
-					}
-					if !found && (entryMs > ms || (entryMs == ms && entrySeq > sq)) {
-						found = true
-					}
-					if found {
-						matching = append(matching, entry)
-					}
+				if !found && (entryMs > ms || (entryMs == ms && entrySeq > sq)) {
+					found = true
+				}
+				if found {
+					matching = append(matching, entry)
 				}
 			}
 			resp.WriteString(fmt.Sprintf("*2\r\n$%d\r\n%s\r\n", len(key), key))
@@ -623,41 +617,79 @@ func handleXRead(conn net.Conn, part []string) {
 			conn.Write([]byte(resp.String()))
 			return
 		}
-		if blockMs > 0 && time.Since(start) >= time.Duration(blockMs)*time.Millisecond {
+		if !blocking || (blockMs > 0 && time.Since(start) >= time.Duration(blockMs)*time.Millisecond) {
+			conn.Write([]byte("$-1\r\n"))
+			return
+		}
+		if !db.sleepUnlocked(10 * time.Millisecond) {
 			conn.Write([]byte("$-1\r\n"))
 			return
 		}
-		time.Sleep(10 * time.Millisecond)
 	}
 }
 
 func handleIncr(conn net.Conn, parts []string, config *Config) {
-	if len(parts) < 2 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'INCR'\r\n"))
-		return
-	}
 	key := parts[1]
 
-	mu.Lock()
-	defer mu.Unlock()
-
-	entry, exists := store[key]
-	if !exists || entry.Expiry.After(time.Time{}) && time.Now().After(entry.Expiry) {
-		store[key] = Entry{Value: "1", Expiry: time.Time{}}
+	obj := db.lookup(key)
+	if !checkType(conn, obj, typeString) {
+		return
+	}
+	if obj == nil {
+		db.set(key, newStringObject("1"))
+		db.dirty++
 		conn.Write([]byte(":1\r\n"))
 		return
 	}
 
-	value, err := strconv.Atoi(entry.Value)
-	if err != nil {
+	value, err := strconv.ParseInt(obj.value.(string), 10, 64)
+	if err != nil || value == math.MaxInt64 {
 		conn.Write([]byte("-ERR value is not an integer or out of range\r\n"))
 		return
 	}
 	value++
-	store[key] = Entry{Value: strconv.Itoa(value), Expiry: entry.Expiry}
-	if config.Role == "master" {
-		conn.Write([]byte(fmt.Sprintf(":%d\r\n", value)))
+	obj.value = strconv.FormatInt(value, 10)
+	db.dirty++
+	conn.Write([]byte(fmt.Sprintf(":%d\r\n", value)))
+}
+
+// handleIncrByFloat adds a floating point increment to a string. The result
+// is propagated as a SET of the new value, as replicas could compute a
+// different one.
+func handleIncrByFloat(conn net.Conn, parts []string, config *Config) {
+	key := parts[1]
+	incr, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+		conn.Write([]byte("-ERR value is not a valid float\r\n"))
+		return
 	}
+
+	obj := db.lookup(key)
+	if !checkType(conn, obj, typeString) {
+		return
+	}
+	value := 0.0
+	if obj != nil {
+		value, err = strconv.ParseFloat(obj.value.(string), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			conn.Write([]byte("-ERR value is not a valid float\r\n"))
+			return
+		}
+	}
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		conn.Write([]byte("-ERR increment would produce NaN or Infinity\r\n"))
+		return
+	}
+	s := strconv.FormatFloat(value, 'f', -1, 64)
+	if obj == nil {
+		db.set(key, newStringObject(s))
+	} else {
+		obj.value = s
+	}
+	db.dirty++
+	db.rewrite = []string{"SET", key, s, "KEEPTTL"}
+	fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(s), s)
 }
 
 func handleExec(conn net.Conn, parts []string, state *clientState, config *Config) {
@@ -665,19 +697,54 @@ func handleExec(conn net.Conn, parts []string, state *clientState, config *Confi
 		conn.Write([]byte("-ERR EXEC without MULTI\r\n"))
 		return
 	}
+	if state.multiError {
+		conn.Write([]byte("-EXECABORT Transaction discarded because of previous errors.\r\n"))
+		state.inMulti = false
+		state.multiError = false
+		state.queue = nil
+		return
+	}
+	// The server may have become a replica since the writes were queued.
+	if replicaReadOnly(config) {
+		for _, parts := range state.queue {
+			if lookupCommand(parts[0]).flags&cmdWrite != 0 {
+				conn.Write([]byte("-EXECABORT Transaction discarded because of: READONLY You can't write against a read only replica.\r\n"))
+				state.inMulti = false
+				state.queue = nil
+				return
+			}
+		}
+	}
+	// Hold the keyspace for the whole queue so no other client observes a
+	// partially applied transaction.
+	db.mu.Lock()
 	conn.Write([]byte(fmt.Sprintf("*%d\r\n", len(state.queue))))
-	for _, cmd := range state.queue {
-		handleCommand(conn, cmd, config)
+	db.inExec = true
+	// Everything the queue propagates, the writes that changed the dataset
+	// and the DEL of keys it found expired, forms a transaction of its own,
+	// so replicas and the AOF apply it together; MULTI is sent before the
+	// first of them, and nothing if there is none.
+	db.multiPending = true
+	for _, parts := range state.queue {
+		cmd := lookupCommand(parts[0])
+		dirty := db.dirty
+		db.rewrite = nil
+		cmd.handler(conn, parts, config)
+		if cmd.flags&cmdWrite != 0 && db.dirty != dirty {
+			propagate(db.propagated(parts), config)
+		}
+	}
+	if !db.multiPending {
+		propagate([]string{"EXEC"}, config)
 	}
+	db.multiPending = false
+	db.inExec = false
+	db.mu.Unlock()
 	state.inMulti = false
 	state.queue = nil
 }
 
 func handleWait(conn net.Conn, parts []string, config *Config) {
-	if len(parts) != 3 {
-		conn.Write([]byte("-ERR wrong number of arguments for 'WAIT'\r\n"))
-		return
-	}
 	numReplicas, err := strconv.Atoi(parts[1])
 	if err != nil || numReplicas < 0 {
 		conn.Write([]byte("-ERR invalid number of replicas\r\n"))
@@ -701,8 +768,8 @@ func handleWait(conn net.Conn, parts []string, config *Config) {
 	for {
 		config.ReplicaMu.Lock()
 		acked = 0
-		for _, off := range config.ReplicaAcks {
-			if off >= targetOffset {
+		for _, r := range config.replicas {
+			if r.ackOffset >= targetOffset {
 				acked++
 			}
 		}
@@ -711,7 +778,9 @@ func handleWait(conn net.Conn, parts []string, config *Config) {
 		if acked >= numReplicas || time.Now().After(deadline) {
 			break
 		}
-		time.Sleep(10 * time.Millisecond)
+		if !db.sleepUnlocked(10 * time.Millisecond) {
+			break
+		}
 	}
 
 	fmt.Fprintf(conn, ":%d\r\n", acked)
@@ -719,10 +788,5 @@ func handleWait(conn net.Conn, parts []string, config *Config) {
 func requestReplicaAcks(config *Config) {
 	config.ReplicaMu.Lock()
 	defer config.ReplicaMu.Unlock()
-	for _, rc := range config.replicaConns {
-		if rc == nil {
-			continue
-		}
-		fmt.Fprintf(rc, "*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n")
-	}
+	feedReplicationStream([]byte("*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n"), config)
 }
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// configParam is a setting that can come from the config file, a --flag or
+// CONFIG SET, and be read back with CONFIG GET. set receives the arguments
+// of the directive; CONFIG SET passes its value as a single argument.
+// Immutable parameters can only be set at startup.
+type configParam struct {
+	name      string
+	immutable bool
+	set       func(config *Config, args []string) error
+	get       func(config *Config) string
+}
+
+var errWrongArgs = errors.New("wrong number of arguments")
+
+var configParams = []*configParam{
+	{"port", true, setPort, func(c *Config) string { return c.Port }},
+	{"replicaof", true, setReplicaOf, func(c *Config) string {
+		if c.Role == "master" {
+			return ""
+		}
+		return c.MasterHost + " " + c.MasterPort
+	}},
+	{"dir", false, setDir, func(c *Config) string { return c.rdb_dir }},
+	{"dbfilename", false, setDBFilename, func(c *Config) string { return c.rdb_filename }},
+	{"proto-max-bulk-len", false, setProtoMaxBulkLen, func(c *Config) string {
+		return strconv.FormatInt(c.ProtoMaxBulkLen, 10)
+	}},
+	{"hz", false, setHz, func(c *Config) string { return strconv.Itoa(c.Hz) }},
+	{"active-expire-effort", false, intParam(1, 10, func(c *Config, n int) { c.ActiveExpireEffort = n }),
+		func(c *Config) string { return strconv.Itoa(c.ActiveExpireEffort) }},
+	{"save", false, setSave, func(c *Config) string { return formatSaveParams(c.SaveParams) }},
+	{"stop-writes-on-bgsave-error", false, boolParam(func(c *Config, b bool) { c.StopWritesOnBgsaveError = b }),
+		func(c *Config) string { return yesNo(c.StopWritesOnBgsaveError) }},
+	{"appendonly", false, setAppendOnly, func(c *Config) string { return yesNo(c.AppendOnly) }},
+	{"appendfilename", true, setAppendFilename, func(c *Config) string { return c.AppendFilename }},
+	{"appenddirname", true, setAppendDirname, func(c *Config) string { return c.AppendDirname }},
+	{"appendfsync", false, setAppendFsync, func(c *Config) string { return c.AppendFsync }},
+	{"aof-load-truncated", false, boolParam(func(c *Config, b bool) { c.AOFLoadTruncated = b }),
+		func(c *Config) string { return yesNo(c.AOFLoadTruncated) }},
+	{"auto-aof-rewrite-percentage", false, intParam(0, math.MaxInt32, func(c *Config, n int) { c.AutoAOFRewritePercentage = n }),
+		func(c *Config) string { return strconv.Itoa(c.AutoAOFRewritePercentage) }},
+	{"auto-aof-rewrite-min-size", false, setAutoAOFRewriteMinSize, func(c *Config) string {
+		return strconv.FormatInt(c.AutoAOFRewriteMinSize, 10)
+	}},
+	{"replica-serve-stale-data", false, boolParam(func(c *Config, b bool) {
+		c.ReplicaMu.Lock()
+		c.ReplicaServeStaleData = b
+		c.ReplicaMu.Unlock()
+	}), func(c *Config) string { return yesNo(c.ReplicaServeStaleData) }},
+	{"replica-read-only", false, boolParam(func(c *Config, b bool) {
+		c.ReplicaMu.Lock()
+		c.ReplicaReadOnly = b
+		c.ReplicaMu.Unlock()
+	}), func(c *Config) string { return yesNo(c.ReplicaReadOnly) }},
+	{"repl-ping-replica-period", false, intParam(1, math.MaxInt32, func(c *Config, n int) { c.ReplPingReplicaPeriod = n }),
+		func(c *Config) string { return strconv.Itoa(c.ReplPingReplicaPeriod) }},
+	{"repl-timeout", false, intParam(1, math.MaxInt32, func(c *Config, n int) { c.ReplTimeout = n }),
+		func(c *Config) string { return strconv.Itoa(c.ReplTimeout) }},
+	{"repl-backlog-size", false, setReplBacklogSize, func(c *Config) string {
+		return strconv.FormatInt(c.ReplBacklogSize, 10)
+	}},
+}
+
+func lookupConfigParam(name string) *configParam {
+	name = strings.ToLower(name)
+	switch name {
+	case "slaveof":
+		name = "replicaof"
+	case "slave-serve-stale-data":
+		name = "replica-serve-stale-data"
+	case "slave-read-only":
+		name = "replica-read-only"
+	case "repl-ping-slave-period":
+		name = "repl-ping-replica-period"
+	}
+	for _, p := range configParams {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func singleArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errWrongArgs
+	}
+	return args[0], nil
+}
+
+func setPort(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(s); err != nil || n < 0 || n > 65535 {
+		return errors.New("argument must be between 0 and 65535 inclusive")
+	}
+	config.Port = s
+	return nil
+}
+
+func setReplicaOf(config *Config, args []string) error {
+	if len(args) != 2 {
+		return errWrongArgs
+	}
+	if strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one") {
+		config.Role = "master"
+		return nil
+	}
+	config.Role = "slave"
+	config.MasterHost, config.MasterPort = args[0], args[1]
+	return nil
+}
+
+func setDir(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s); err != nil || !fi.IsDir() {
+		return fmt.Errorf("can't use '%s' as the data directory", s)
+	}
+	config.rdb_dir = s
+	return nil
+}
+
+func setDBFilename(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	if s == "" || strings.ContainsRune(s, '/') {
+		return errors.New("dbfilename can't be a path, just a filename")
+	}
+	config.rdb_filename = s
+	return nil
+}
+
+// setAppendOnly turns the AOF on or off. Once the server runs, turning it
+// on starts a rewrite that writes the dataset as the new base.
+func setAppendOnly(config *Config, args []string) error {
+	var on bool
+	if err := boolParam(func(_ *Config, b bool) { on = b })(config, args); err != nil {
+		return err
+	}
+	if aofLog.started && on != config.AppendOnly {
+		if on {
+			if err := startAppendOnly(config); err != nil {
+				return err
+			}
+		} else {
+			stopAppendOnly(config)
+		}
+	}
+	config.AppendOnly = on
+	return nil
+}
+
+func setAppendFilename(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	if s == "" || strings.ContainsRune(s, '/') {
+		return errors.New("appendfilename can't be a path, just a filename")
+	}
+	config.AppendFilename = s
+	return nil
+}
+
+func setAppendDirname(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	if s == "" || strings.ContainsRune(s, '/') {
+		return errors.New("appenddirname can't be a path, just a dirname")
+	}
+	config.AppendDirname = s
+	return nil
+}
+
+func setAppendFsync(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	switch s = strings.ToLower(s); s {
+	case "always", "everysec", "no":
+		config.AppendFsync = s
+		return nil
+	}
+	return errors.New("argument(s) must be one of the following: always, everysec, no")
+}
+
+func setAutoAOFRewriteMinSize(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	n, err := parseMemory(s)
+	if err != nil || n < 0 {
+		return errors.New("argument must be a memory value")
+	}
+	config.AutoAOFRewriteMinSize = n
+	return nil
+}
+
+// setReplBacklogSize resizes the backlog, if there is one, keeping the most
+// recent part of its history. Sizes below the minimum are raised to it.
+func setReplBacklogSize(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	n, err := parseMemory(s)
+	if err != nil || n < 1 {
+		return errors.New("argument must be a memory value")
+	}
+	if n < minReplBacklogSize {
+		n = minReplBacklogSize
+	}
+	config.ReplicaMu.Lock()
+	defer config.ReplicaMu.Unlock()
+	config.ReplBacklogSize = n
+	if config.backlog != nil {
+		config.backlog.resize(n)
+	}
+	return nil
+}
+
+func setProtoMaxBulkLen(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	n, err := parseMemory(s)
+	if err != nil || n < 1 {
+		return errors.New("argument must be a memory value")
+	}
+	config.ProtoMaxBulkLen = n
+	return nil
+}
+
+// setHz clamps like Redis does rather than rejecting large values.
+func setHz(config *Config, args []string) error {
+	s, err := singleArg(args)
+	if err != nil {
+		return err
+	}
+	hz, err := strconv.Atoi(s)
+	if err != nil || hz < 1 {
+		return errors.New("argument must be between 1 and 500 inclusive")
+	}
+	config.Hz = min(hz, 500)
+	return nil
+}
+
+func intParam(lo, hi int, store func(*Config, int)) func(*Config, []string) error {
+	return func(config *Config, args []string) error {
+		s, err := singleArg(args)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return fmt.Errorf("argument must be between %d and %d inclusive", lo, hi)
+		}
+		store(config, n)
+		return nil
+	}
+}
+
+func boolParam(store func(*Config, bool)) func(*Config, []string) error {
+	return func(config *Config, args []string) error {
+		s, err := singleArg(args)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(s) {
+		case "yes":
+			store(config, true)
+		case "no":
+			store(config, false)
+		default:
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+		return nil
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// setSave replaces the save points with "<seconds> <changes>" pairs; no
+// pairs, or a single empty argument, disables automatic snapshots.
+func setSave(config *Config, args []string) error {
+	fields := strings.Fields(strings.Join(args, " "))
+	if len(fields)%2 != 0 {
+		return errors.New("Invalid save parameters")
+	}
+	params := []saveParam{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return errors.New("Invalid save parameters")
+		}
+		params = append(params, saveParam{seconds: seconds, changes: changes})
+	}
+	config.SaveParams = params
+	return nil
+}
+
+func formatSaveParams(params []saveParam) string {
+	var parts []string
+	for _, sp := range params {
+		parts = append(parts, strconv.Itoa(sp.seconds), strconv.FormatInt(sp.changes, 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+// configDirective is one line of the config file or one --flag with its
+// arguments; line is 0 for flags.
+type configDirective struct {
+	line int
+	name string
+	args []string
+}
+
+// loadConfig builds the configuration from an optional config file,
+// followed by the command line flags, which therefore take precedence. It
+// exits on the first invalid directive, as Redis does.
+func loadConfig(config *Config, args []string) {
+	var directives []configDirective
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		ds, err := readConfigFile(args[0])
+		if err != nil {
+			fmt.Printf("Fatal error, can't open config file '%s': %v\n", args[0], err)
+			os.Exit(1)
+		}
+		directives = ds
+		args = args[1:]
+	}
+	directives = append(directives, flagDirectives(args)...)
+
+	// The first save directive replaces the default save points; further
+	// ones add to them, so a config file can list one per line.
+	saveSeen := false
+	for _, d := range directives {
+		p := lookupConfigParam(d.name)
+		var err error
+		if p == nil {
+			err = errors.New("Bad directive or wrong number of arguments")
+		} else if p.name == "save" {
+			previous := config.SaveParams
+			if err = p.set(config, d.args); err == nil && saveSeen {
+				config.SaveParams = append(previous, config.SaveParams...)
+			}
+			saveSeen = true
+		} else {
+			err = p.set(config, d.args)
+		}
+		if err != nil {
+			fmt.Println("*** FATAL CONFIG FILE ERROR ***")
+			if d.line > 0 {
+				fmt.Printf("Reading the configuration file, at line %d\n", d.line)
+			}
+			fmt.Printf(">>> '%s %s'\n", d.name, strings.Join(d.args, " "))
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+}
+
+// readConfigFile parses a redis.conf style file: one directive per line,
+// arguments split and unquoted like inline commands, # starting a comment.
+func readConfigFile(filename string) ([]configDirective, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var directives []configDirective
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		directives = append(directives, configDirective{line: n, name: args[0], args: args[1:]})
+	}
+	return directives, scanner.Err()
+}
+
+// flagDirectives turns "--name arg..." flags into directives. An argument
+// holding several words, as in --replicaof "host port", is split into
+// them; an empty one, as in --save "", is kept.
+func flagDirectives(args []string) []configDirective {
+	var directives []configDirective
+	for _, a := range args {
+		if strings.HasPrefix(a, "--") {
+			directives = append(directives, configDirective{name: a[2:]})
+			continue
+		}
+		if len(directives) == 0 {
+			continue
+		}
+		d := &directives[len(directives)-1]
+		if fields := strings.Fields(a); len(fields) > 0 {
+			d.args = append(d.args, fields...)
+		} else {
+			d.args = append(d.args, a)
+		}
+	}
+	return directives
+}
+
+func handleConfig(conn net.Conn, parts []string, config *Config) {
+	switch strings.ToUpper(parts[1]) {
+	case "GET":
+		if len(parts) < 3 {
+			conn.Write([]byte("-ERR wrong number of arguments for 'config|get' command\r\n"))
+			return
+		}
+		var response []string
+		for _, p := range configParams {
+			for _, pattern := range parts[2:] {
+				if stringMatch(pattern, p.name, true) {
+					response = append(response, p.name, p.get(config))
+					break
+				}
+			}
+		}
+		conn.Write(encodeArray(response))
+	case "SET":
+		if len(parts) < 4 || len(parts)%2 != 0 {
+			conn.Write([]byte("-ERR wrong number of arguments for 'config|set' command\r\n"))
+			return
+		}
+		handleConfigSet(conn, parts[2:], config)
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'. Try CONFIG HELP.\r\n", parts[1])
+	}
+}
+
+// handleConfigSet applies "name value" pairs all or nothing: every name is
+// checked before anything is set, and if a value is rejected the ones set
+// before it are restored.
+func handleConfigSet(conn net.Conn, pairs []string, config *Config) {
+	params := make([]*configParam, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		p := lookupConfigParam(pairs[i])
+		if p == nil {
+			fmt.Fprintf(conn, "-ERR Unknown option or number of arguments for CONFIG SET - '%s'\r\n", pairs[i])
+			return
+		}
+		if slices.Contains(params, p) {
+			fmt.Fprintf(conn, "-ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter\r\n", pairs[i])
+			return
+		}
+		if p.immutable {
+			fmt.Fprintf(conn, "-ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config\r\n", pairs[i])
+			return
+		}
+		params = append(params, p)
+	}
+	old := make([]string, len(params))
+	for i, p := range params {
+		old[i] = p.get(config)
+		if err := p.set(config, []string{pairs[2*i+1]}); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				params[j].set(config, []string{old[j]})
+			}
+			fmt.Fprintf(conn, "-ERR CONFIG SET failed (possibly related to argument '%s') - %v\r\n", pairs[2*i], err)
+			return
+		}
+	}
+	conn.Write([]byte("+OK\r\n"))
+}
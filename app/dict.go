@@ -0,0 +1,190 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+)
+
+// dictMinSize is the smallest non-empty table; a table shrinks once fewer
+// than 1 in dictMinFill buckets would be used.
+const (
+	dictMinSize = 4
+	dictMinFill = 10
+)
+
+var dictSeed = maphash.MakeSeed()
+
+// dict is a chained hash table with a power-of-two number of buckets. It
+// takes the place of a Go map wherever SCAN must iterate: a bucket index is
+// a stable position across calls, which lets scan promise that an element
+// present for the whole iteration is returned even if the table was resized
+// in between.
+type dict[V any] struct {
+	table []*dictEntry[V]
+	used  int
+}
+
+type dictEntry[V any] struct {
+	key  string
+	val  V
+	next *dictEntry[V]
+}
+
+func newDict[V any]() *dict[V] {
+	return &dict[V]{}
+}
+
+func (d *dict[V]) len() int {
+	return d.used
+}
+
+func (d *dict[V]) bucket(key string) int {
+	return int(maphash.String(dictSeed, key) & uint64(len(d.table)-1))
+}
+
+func (d *dict[V]) find(key string) *dictEntry[V] {
+	if d.used == 0 {
+		return nil
+	}
+	for e := d.table[d.bucket(key)]; e != nil; e = e.next {
+		if e.key == key {
+			return e
+		}
+	}
+	return nil
+}
+
+func (d *dict[V]) get(key string) (V, bool) {
+	if e := d.find(key); e != nil {
+		return e.val, true
+	}
+	var zero V
+	return zero, false
+}
+
+// set stores val at key, reporting whether the key is new.
+func (d *dict[V]) set(key string, val V) bool {
+	if e := d.find(key); e != nil {
+		e.val = val
+		return false
+	}
+	if d.used >= len(d.table) {
+		d.resize(max(dictMinSize, 2*len(d.table)))
+	}
+	i := d.bucket(key)
+	d.table[i] = &dictEntry[V]{key: key, val: val, next: d.table[i]}
+	d.used++
+	return true
+}
+
+func (d *dict[V]) delete(key string) bool {
+	if d.used == 0 {
+		return false
+	}
+	i := d.bucket(key)
+	for p := &d.table[i]; *p != nil; p = &(*p).next {
+		if (*p).key == key {
+			*p = (*p).next
+			d.used--
+			if len(d.table) > dictMinSize && d.used*dictMinFill < len(d.table) {
+				d.resize(max(dictMinSize, 1<<bits.Len(uint(d.used))))
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// resize rehashes every entry into a table of size buckets at once. Redis
+// rehashes incrementally to bound latency; here the caller holds the
+// keyspace lock either way, and a single table keeps scan simple.
+func (d *dict[V]) resize(size int) {
+	old := d.table
+	d.table = make([]*dictEntry[V], size)
+	for _, e := range old {
+		for e != nil {
+			next := e.next
+			i := d.bucket(e.key)
+			e.next = d.table[i]
+			d.table[i] = e
+			e = next
+		}
+	}
+}
+
+// clear removes every entry and releases the table.
+func (d *dict[V]) clear() {
+	d.table = nil
+	d.used = 0
+}
+
+// each calls fn for every entry until fn returns false. fn must not modify
+// the dict.
+func (d *dict[V]) each(fn func(key string, val V) bool) {
+	for _, e := range d.table {
+		for ; e != nil; e = e.next {
+			if !fn(e.key, e.val) {
+				return
+			}
+		}
+	}
+}
+
+// clone returns a copy of d; values are copied as by assignment.
+func (d *dict[V]) clone() *dict[V] {
+	c := &dict[V]{table: make([]*dictEntry[V], len(d.table)), used: d.used}
+	for i, e := range d.table {
+		for ; e != nil; e = e.next {
+			c.table[i] = &dictEntry[V]{key: e.key, val: e.val, next: c.table[i]}
+		}
+	}
+	return c
+}
+
+// randomEntry returns an entry chosen by picking a random non-empty bucket
+// and then a random element of its chain. The minimum fill keeps the
+// expected number of probes low.
+func (d *dict[V]) randomEntry() (string, V, bool) {
+	if d.used == 0 {
+		var zero V
+		return "", zero, false
+	}
+	var head *dictEntry[V]
+	for head == nil {
+		head = d.table[rand.Intn(len(d.table))]
+	}
+	n := 0
+	for e := head; e != nil; e = e.next {
+		n++
+	}
+	e := head
+	for i := rand.Intn(n); i > 0; i-- {
+		e = e.next
+	}
+	return e.key, e.val, true
+}
+
+// scan calls fn for every entry of one bucket and returns the cursor for
+// the next call, 0 once the iteration is complete. Start with cursor 0.
+//
+// The cursor is incremented on its reversed bits, so it walks the buckets
+// high bits first: with a table of 8, the order is 0 4 2 6 1 5 3 7. When a
+// table doubles, bucket b splits into b and b+size, both of which the
+// higher bits visit after b; when it halves, buckets b and b+size/2 merge
+// into one not visited yet. Entries are never missed, though after a
+// shrink some may be returned twice.
+func (d *dict[V]) scan(cursor uint64, fn func(key string, val V)) uint64 {
+	if d.used == 0 {
+		return 0
+	}
+	mask := uint64(len(d.table) - 1)
+	for e := d.table[cursor&mask]; e != nil; e = e.next {
+		fn(e.key, e.val)
+	}
+	// Set the unmasked bits so the increment carries past them.
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
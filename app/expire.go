@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+)
+
+// Active expiry tuning at active-expire-effort 1; every effort step above
+// that samples more keys, tolerates fewer stale keys and allows more time.
+const (
+	activeExpireKeysPerLoop  = 20 // keys sampled per iteration
+	activeExpireAcceptStale  = 10 // % of stale keys tolerated in a sample
+	activeExpireCycleCPUPerc = 25 // max % of each 1/hz tick spent expiring
+)
+
+// activeExpireLoop reclaims keys that expired but are never read again. It
+// runs hz times per second on masters only; replicas wait for the master to
+// tell them which keys are gone.
+func activeExpireLoop(config *Config) {
+	for {
+		db.mu.Lock()
+		hz := config.Hz
+		db.mu.Unlock()
+		time.Sleep(time.Second / time.Duration(hz))
+		db.mu.Lock()
+		master := config.Role == "master"
+		db.mu.Unlock()
+		if !master {
+			continue
+		}
+		activeExpireCycle(config)
+	}
+}
+
+// activeExpireCycle samples keys with a TTL and deletes the expired ones,
+// repeating while the sample shows more stale keys than acceptable and the
+// time budget for this tick is not used up. The keyspace is locked per
+// sample only, so clients interleave with a long cycle.
+func activeExpireCycle(config *Config) {
+	db.mu.Lock()
+	effort := config.ActiveExpireEffort - 1
+	hz := config.Hz
+	db.mu.Unlock()
+
+	perLoop := activeExpireKeysPerLoop + activeExpireKeysPerLoop/4*effort
+	acceptStale := activeExpireAcceptStale - effort
+	budget := time.Second * time.Duration(activeExpireCycleCPUPerc+2*effort) / 100 / time.Duration(hz)
+
+	start := time.Now()
+	totalSampled, totalExpired := 0, 0
+	for {
+		db.mu.Lock()
+		sampled, expired := db.expireSample(perLoop)
+		db.mu.Unlock()
+		totalSampled += sampled
+		totalExpired += expired
+		if sampled == 0 || expired*100/sampled <= acceptStale {
+			break
+		}
+		if time.Since(start) > budget {
+			db.mu.Lock()
+			db.expiredTimeCapReached++
+			db.mu.Unlock()
+			break
+		}
+	}
+
+	currentPerc := 0.0
+	if totalSampled > 0 {
+		currentPerc = float64(totalExpired) / float64(totalSampled)
+	}
+	db.mu.Lock()
+	db.expiredStalePerc = currentPerc*0.05 + db.expiredStalePerc*0.95
+	db.mu.Unlock()
+}
+
+// expireSample checks up to n keys from the expires index, starting at a
+// random point as Go map iteration does, and deletes those that expired.
+func (ks *keyspace) expireSample(n int) (sampled, expired int) {
+	now := time.Now()
+	for key := range ks.expires {
+		if sampled == n {
+			break
+		}
+		sampled++
+		obj, ok := ks.dict.get(key)
+		if !ok {
+			// The index should never outlive its key; if it does, drop
+			// the stale entry rather than trip over it.
+			delete(ks.expires, key)
+			continue
+		}
+		if obj.expired(now) {
+			ks.deleteExpired(key)
+			expired++
+		}
+	}
+	return sampled, expired
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expireDeadline turns an expire argument into an absolute deadline. unit is
+// time.Second or time.Millisecond, and absolute selects the *AT variants that
+// take a unix timestamp instead of a relative TTL. It reports false if the
+// result does not fit in milliseconds since the epoch.
+func expireDeadline(n int64, unit time.Duration, absolute bool) (time.Time, bool) {
+	ms := n
+	if unit == time.Second {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return time.Time{}, false
+		}
+		ms = n * 1000
+	}
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if ms > math.MaxInt64-now {
+			return time.Time{}, false
+		}
+		ms += now
+	}
+	return time.UnixMilli(ms), true
+}
+
+func handleExpire(conn net.Conn, parts []string, config *Config) {
+	expireGeneric(conn, parts, time.Second, false, config)
+}
+
+func handlePExpire(conn net.Conn, parts []string, config *Config) {
+	expireGeneric(conn, parts, time.Millisecond, false, config)
+}
+
+func handleExpireAt(conn net.Conn, parts []string, config *Config) {
+	expireGeneric(conn, parts, time.Second, true, config)
+}
+
+func handlePExpireAt(conn net.Conn, parts []string, config *Config) {
+	expireGeneric(conn, parts, time.Millisecond, true, config)
+}
+
+func expireGeneric(conn net.Conn, parts []string, unit time.Duration, absolute bool, config *Config) {
+	key := parts[1]
+	n, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		conn.Write([]byte("-ERR value is not an integer or out of range\r\n"))
+		return
+	}
+	var nx, xx, gt, lt bool
+	for _, opt := range parts[3:] {
+		switch strings.ToUpper(opt) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			fmt.Fprintf(conn, "-ERR Unsupported option %s\r\n", opt)
+			return
+		}
+	}
+	if nx && (xx || gt || lt) {
+		conn.Write([]byte("-ERR NX and XX, GT or LT options at the same time are not compatible\r\n"))
+		return
+	}
+	if gt && lt {
+		conn.Write([]byte("-ERR GT and LT options at the same time are not compatible\r\n"))
+		return
+	}
+	when, ok := expireDeadline(n, unit, absolute)
+	if !ok {
+		fmt.Fprintf(conn, "-ERR invalid expire time in '%s' command\r\n", strings.ToLower(parts[0]))
+		return
+	}
+
+	obj := db.lookup(key)
+	if obj == nil {
+		conn.Write([]byte(":0\r\n"))
+		return
+	}
+	// A missing TTL counts as infinite for GT and LT.
+	current := obj.expiry
+	if (nx && !current.IsZero()) ||
+		(xx && current.IsZero()) ||
+		(gt && (current.IsZero() || !when.After(current))) ||
+		(lt && !current.IsZero() && !when.Before(current)) {
+		conn.Write([]byte(":0\r\n"))
+		return
+	}
+	// A deadline in the past deletes the key, except on replicas which wait
+	// for the master to decide. Replicas are sent the DEL instead of this
+	// command, so dirty is left alone to keep it from being propagated.
+	if !when.After(time.Now()) && config.Role == "master" {
+		db.deleteExpired(key)
+		conn.Write([]byte(":1\r\n"))
+		return
+	}
+	db.setExpire(key, when)
+	db.dirty++
+	// Whatever the form of the command, the deadline is propagated as an
+	// absolute one, which does not depend on when it is applied.
+	db.rewrite = []string{"PEXPIREAT", key, strconv.FormatInt(when.UnixMilli(), 10)}
+	conn.Write([]byte(":1\r\n"))
+}
+
+func handleTTL(conn net.Conn, parts []string, config *Config) {
+	ttlGeneric(conn, parts[1], time.Second, false)
+}
+
+func handlePTTL(conn net.Conn, parts []string, config *Config) {
+	ttlGeneric(conn, parts[1], time.Millisecond, false)
+}
+
+func handleExpireTime(conn net.Conn, parts []string, config *Config) {
+	ttlGeneric(conn, parts[1], time.Second, true)
+}
+
+func handlePExpireTime(conn net.Conn, parts []string, config *Config) {
+	ttlGeneric(conn, parts[1], time.Millisecond, true)
+}
+
+// ttlGeneric replies with the remaining TTL, or the absolute deadline when
+// absolute is set, in the given unit: -2 if the key does not exist and -1 if
+// it has no expiry.
+func ttlGeneric(conn net.Conn, key string, unit time.Duration, absolute bool) {
+	obj := db.lookup(key)
+	if obj == nil {
+		conn.Write([]byte(":-2\r\n"))
+		return
+	}
+	if obj.expiry.IsZero() {
+		conn.Write([]byte(":-1\r\n"))
+		return
+	}
+	var ms int64
+	if absolute {
+		ms = obj.expiry.UnixMilli()
+	} else {
+		ms = max(time.Until(obj.expiry).Milliseconds(), 0)
+	}
+	if unit == time.Second {
+		if absolute {
+			ms /= 1000
+		} else {
+			ms = (ms + 500) / 1000
+		}
+	}
+	fmt.Fprintf(conn, ":%d\r\n", ms)
+}
+
+func handlePersist(conn net.Conn, parts []string, config *Config) {
+	if db.lookup(parts[1]) == nil || !db.removeExpire(parts[1]) {
+		conn.Write([]byte(":0\r\n"))
+		return
+	}
+	db.dirty++
+	conn.Write([]byte(":1\r\n"))
+}
@@ -0,0 +1,131 @@
+package main
+
+// stringMatch reports whether s matches the glob pattern, with the same
+// rules as Redis: '*' matches any sequence of characters including none,
+// '?' any single character, "[abc]" one of the listed characters, "[a-z]"
+// a range and "[^a]" anything but a; '\' quotes the next character, also
+// inside brackets. An unterminated '[' set runs to the end of the pattern.
+// Characters are bytes, as keys are binary safe.
+func stringMatch(pattern, s string, nocase bool) bool {
+	skipLonger := false
+	return globMatch(pattern, s, nocase, &skipLonger, 0)
+}
+
+// globMatch is stringMatch with two guards against patterns like "a*a*a*b"
+// whose backtracking would otherwise be exponential: once the rest of the
+// pattern after a * failed to match a suffix of s, it cannot match a
+// shorter one either (skipLonger), and recursion depth is bounded.
+func globMatch(p, s string, nocase bool, skipLonger *bool, nesting int) bool {
+	if nesting > 1000 {
+		return false
+	}
+	for len(p) > 0 && len(s) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 1 && p[1] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 1 {
+				return true
+			}
+			for len(s) > 0 {
+				if globMatch(p[1:], s, nocase, skipLonger, nesting+1) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+				s = s[1:]
+			}
+			*skipLonger = true
+			return false
+		case '?':
+			s = s[1:]
+		case '[':
+			p = p[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+			match := false
+			for len(p) > 0 {
+				if p[0] == '\\' && len(p) >= 2 {
+					p = p[1:]
+					if p[0] == s[0] {
+						match = true
+					}
+				} else if p[0] == ']' {
+					break
+				} else if len(p) >= 3 && p[1] == '-' {
+					start, end, c := p[0], p[2], s[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					p = p[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(p[0], s[0], nocase) {
+					match = true
+				}
+				p = p[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(p) >= 2 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if !equalByte(p[0], s[0], nocase) {
+				return false
+			}
+			s = s[1:]
+		}
+		if len(p) > 0 { // empty after an unterminated [
+			p = p[1:]
+		}
+		if len(s) == 0 {
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			break
+		}
+	}
+	return len(p) == 0 && len(s) == 0
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// isGlobPattern reports whether pattern contains any special character, so
+// callers can use a direct lookup instead of matching every key.
+func isGlobPattern(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const redisVersion = "7.2.0"
+
+var serverStartTime = time.Now()
+
+// infoSections lists INFO sections in output order. Sections marked as
+// defaults are the ones a bare INFO returns.
+var infoSections = []struct {
+	name     string
+	defaults bool
+	gen      func(config *Config) string
+}{
+	{"server", true, serverInfo},
+	{"memory", true, memoryInfo},
+	{"persistence", true, persistenceInfo},
+	{"stats", true, statsInfo},
+	{"replication", true, replicationInfo},
+	{"keyspace", true, keyspaceInfo},
+}
+
+func handleInfo(conn net.Conn, parts []string, config *Config) {
+	wanted := map[string]bool{}
+	for _, p := range parts[1:] {
+		wanted[strings.ToLower(p)] = true
+	}
+	all := wanted["all"] || wanted["everything"]
+	defaults := len(wanted) == 0 || wanted["default"]
+
+	var sections []string
+	for _, s := range infoSections {
+		if all || wanted[s.name] || (defaults && s.defaults) {
+			title := strings.ToUpper(s.name[:1]) + s.name[1:]
+			sections = append(sections, "# "+title+"\r\n"+s.gen(config))
+		}
+	}
+	info := strings.Join(sections, "\r\n")
+	conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)))
+}
+
+func serverInfo(config *Config) string {
+	uptime := int64(time.Since(serverStartTime).Seconds())
+	return fmt.Sprintf(
+		"redis_version:%s\r\nprocess_id:%d\r\ntcp_port:%s\r\nuptime_in_seconds:%d\r\nuptime_in_days:%d\r\nhz:%d\r\n",
+		redisVersion, os.Getpid(), config.Port, uptime, uptime/86400, config.Hz,
+	)
+}
+
+func memoryInfo(config *Config) string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return fmt.Sprintf(
+		"used_memory:%d\r\n",
+		m.HeapAlloc,
+	)
+}
+
+func statsInfo(config *Config) string {
+	return fmt.Sprintf(
+		"expired_keys:%d\r\nexpired_stale_perc:%.2f\r\nexpired_time_cap_reached_count:%d\r\n",
+		db.expiredKeys, db.expiredStalePerc*100, db.expiredTimeCapReached,
+	)
+}
+
+func keyspaceInfo(config *Config) string {
+	if db.dict.len() == 0 {
+		return ""
+	}
+	return fmt.Sprintf("db0:keys=%d,expires=%d,avg_ttl=0\r\n", db.dict.len(), len(db.expires))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type valueType int
+
+const (
+	typeString valueType = iota
+	typeList
+	typeSet
+	typeZSet
+	typeHash
+	typeStream
+)
+
+func (t valueType) String() string {
+	switch t {
+	case typeString:
+		return "string"
+	case typeList:
+		return "list"
+	case typeSet:
+		return "set"
+	case typeZSet:
+		return "zset"
+	case typeHash:
+		return "hash"
+	case typeStream:
+		return "stream"
+	}
+	return "unknown"
+}
+
+// redisObject is a value in the keyspace. value holds a string for
+// typeString, a []string for typeList, a *dict[struct{}] for typeSet, a
+// *dict[float64] of member scores for typeZSet, a *dict[string] for
+// typeHash and a []StreamEntry for typeStream.
+// A zero expiry means the key never expires.
+type redisObject struct {
+	typ    valueType
+	value  interface{}
+	expiry time.Time
+}
+
+func (o *redisObject) expired(now time.Time) bool {
+	return !o.expiry.IsZero() && now.After(o.expiry)
+}
+
+// dup returns a deep copy of o that shares no mutable state with it.
+func (o *redisObject) dup() *redisObject {
+	c := &redisObject{typ: o.typ, expiry: o.expiry}
+	switch v := o.value.(type) {
+	case string:
+		c.value = v
+	case []string:
+		c.value = append([]string(nil), v...)
+	case *dict[struct{}]:
+		c.value = v.clone()
+	case *dict[float64]:
+		c.value = v.clone()
+	case *dict[string]:
+		c.value = v.clone()
+	case []StreamEntry:
+		entries := make([]StreamEntry, len(v))
+		for i, e := range v {
+			fields := make(map[string]string, len(e.Fields))
+			for k, fv := range e.Fields {
+				fields[k] = fv
+			}
+			entries[i] = StreamEntry{ID: e.ID, Fields: fields}
+		}
+		c.value = entries
+	}
+	return c
+}
+
+func newStringObject(s string) *redisObject {
+	return &redisObject{typ: typeString, value: s}
+}
+
+func newListObject() *redisObject {
+	return &redisObject{typ: typeList, value: []string{}}
+}
+
+func newStreamObject() *redisObject {
+	return &redisObject{typ: typeStream, value: []StreamEntry{}}
+}
+
+// keyspace maps every key to exactly one typed value. mu is held by call for
+// the whole execution of a command, so handlers access dict without locking.
+type keyspace struct {
+	mu   sync.Mutex
+	dict *dict[*redisObject]
+	// expires indexes the keys that have a TTL, for active expiry to sample.
+	expires map[string]struct{}
+	// dirty counts changes made by write commands. Handlers bump it for
+	// every modification, and only commands that changed it are propagated.
+	dirty int64
+	// inExec is set while EXEC runs its queue; blocking commands must not
+	// wait then, as releasing mu would break the transaction's atomicity.
+	inExec bool
+	// multiPending is set while EXEC runs its queue and has propagated
+	// nothing yet. Whatever comes first, one of its writes or the DEL of a
+	// key found expired, is preceded by MULTI, opening the block before it.
+	multiPending bool
+	// masterLink is set while a command from the replication stream runs.
+	// The master decides when keys expire, so its commands see them all.
+	masterLink bool
+	// loading is set while the AOF is replayed; like inExec, blocking
+	// commands must not wait then.
+	loading bool
+	// rewrite is set by a handler whose command would not have the same
+	// effect if run again elsewhere, such as XADD with a generated ID or a
+	// relative expiry: it is propagated instead, spelling out the result.
+	rewrite []string
+	config  *Config
+
+	expiredKeys           int64
+	expiredStalePerc      float64
+	expiredTimeCapReached int64
+}
+
+var db = &keyspace{
+	dict:    newDict[*redisObject](),
+	expires: make(map[string]struct{}),
+}
+
+// propagated returns what to propagate for the command parts that just
+// ran: the rewrite its handler set, if any, or the command itself.
+func (ks *keyspace) propagated(parts []string) []string {
+	argv := parts
+	if ks.rewrite != nil {
+		argv = ks.rewrite
+		ks.rewrite = nil
+	}
+	return argv
+}
+
+// lookup returns the live object stored at key. An expired key is deleted
+// on a master, which propagates the deletion; a replica only hides it from
+// clients and keeps it until the master's DEL arrives.
+func (ks *keyspace) lookup(key string) *redisObject {
+	obj, ok := ks.dict.get(key)
+	if !ok {
+		return nil
+	}
+	if obj.expired(time.Now()) {
+		if ks.masterLink {
+			return obj
+		}
+		if ks.config.Role == "master" {
+			ks.deleteExpired(key)
+		}
+		return nil
+	}
+	return obj
+}
+
+// set stores obj at key, replacing any previous value and its TTL with
+// obj's.
+func (ks *keyspace) set(key string, obj *redisObject) {
+	ks.dict.set(key, obj)
+	if obj.expiry.IsZero() {
+		delete(ks.expires, key)
+	} else {
+		ks.expires[key] = struct{}{}
+	}
+}
+
+func (ks *keyspace) delete(key string) bool {
+	if !ks.dict.delete(key) {
+		return false
+	}
+	delete(ks.expires, key)
+	return true
+}
+
+// deleteExpired removes a key whose TTL has elapsed and propagates an
+// explicit DEL, so replicas never have to expire keys on their own clock
+// and the AOF does not depend on when it is replayed.
+func (ks *keyspace) deleteExpired(key string) {
+	ks.delete(key)
+	ks.expiredKeys++
+	propagate([]string{"DEL", key}, ks.config)
+}
+
+// setExpire makes the key expire at when. The key must exist.
+func (ks *keyspace) setExpire(key string, when time.Time) {
+	obj, _ := ks.dict.get(key)
+	obj.expiry = when
+	ks.expires[key] = struct{}{}
+}
+
+// removeExpire makes the key persistent, reporting whether it had a TTL.
+func (ks *keyspace) removeExpire(key string) bool {
+	obj, ok := ks.dict.get(key)
+	if !ok || obj.expiry.IsZero() {
+		return false
+	}
+	obj.expiry = time.Time{}
+	delete(ks.expires, key)
+	return true
+}
+
+// flush removes every key and returns how many there were. Clearing the
+// dict only drops its table, which the garbage collector reclaims off the
+// request path, so FLUSHALL ASYNC needs nothing more than SYNC.
+func (ks *keyspace) flush() int {
+	n := ks.dict.len()
+	ks.dict.clear()
+	clear(ks.expires)
+	return n
+}
+
+// randomKey returns a random live key. A master deletes the expired keys it
+// draws and tries again; a replica cannot, so after 100 expired draws it
+// returns one anyway rather than loop forever over a keyspace of stale keys.
+func (ks *keyspace) randomKey() (string, bool) {
+	for tries := 1; ; tries++ {
+		key, _, ok := ks.dict.randomEntry()
+		if !ok {
+			return "", false
+		}
+		if ks.lookup(key) != nil || (ks.config.Role != "master" && tries >= 100) {
+			return key, true
+		}
+	}
+}
+
+// sleepUnlocked releases the keyspace for d so other clients can run while a
+// blocking command waits. Inside EXEC, while loading or on the master link
+// it returns false without sleeping, and the caller should behave as if its
+// timeout had elapsed. The waiting command's rewrite is kept from the
+// commands that run meanwhile.
+func (ks *keyspace) sleepUnlocked(d time.Duration) bool {
+	if ks.inExec || ks.loading || ks.masterLink {
+		return false
+	}
+	rewrite := ks.rewrite
+	ks.mu.Unlock()
+	time.Sleep(d)
+	ks.mu.Lock()
+	ks.rewrite = rewrite
+	return true
+}
+
+// checkType replies with WRONGTYPE and returns false if obj exists but is
+// not of type t.
+func checkType(conn net.Conn, obj *redisObject, t valueType) bool {
+	if obj != nil && obj.typ != t {
+		conn.Write([]byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"))
+		return false
+	}
+	return true
+}
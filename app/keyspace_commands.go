@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+func handleDel(conn net.Conn, parts []string, config *Config) {
+	deleted := 0
+	for _, key := range parts[1:] {
+		if db.lookup(key) != nil && db.delete(key) {
+			deleted++
+		}
+	}
+	db.dirty += int64(deleted)
+	fmt.Fprintf(conn, ":%d\r\n", deleted)
+}
+
+// handleUnlink is DEL: the value is detached from the keyspace in constant
+// time and reclaimed by the garbage collector off the request path.
+func handleUnlink(conn net.Conn, parts []string, config *Config) {
+	handleDel(conn, parts, config)
+}
+
+func handleExists(conn net.Conn, parts []string, config *Config) {
+	count := 0
+	for _, key := range parts[1:] {
+		if db.lookup(key) != nil {
+			count++
+		}
+	}
+	fmt.Fprintf(conn, ":%d\r\n", count)
+}
+
+func handleTouch(conn net.Conn, parts []string, config *Config) {
+	handleExists(conn, parts, config)
+}
+
+func handleRename(conn net.Conn, parts []string, config *Config) {
+	renameKey(conn, parts[1], parts[2], false, config)
+}
+
+func handleRenameNX(conn net.Conn, parts []string, config *Config) {
+	renameKey(conn, parts[1], parts[2], true, config)
+}
+
+func renameKey(conn net.Conn, src, dst string, nx bool, config *Config) {
+	obj := db.lookup(src)
+	if obj == nil {
+		conn.Write([]byte("-ERR no such key\r\n"))
+		return
+	}
+	if src == dst {
+		if nx {
+			conn.Write([]byte(":0\r\n"))
+		} else {
+			conn.Write([]byte("+OK\r\n"))
+		}
+		return
+	}
+	if nx && db.lookup(dst) != nil {
+		conn.Write([]byte(":0\r\n"))
+		return
+	}
+	db.delete(src)
+	db.set(dst, obj)
+	db.dirty++
+	if nx {
+		conn.Write([]byte(":1\r\n"))
+	} else {
+		conn.Write([]byte("+OK\r\n"))
+	}
+}
+
+func handleCopy(conn net.Conn, parts []string, config *Config) {
+	src, dst := parts[1], parts[2]
+	replace := false
+	for i := 3; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(parts) {
+				conn.Write([]byte("-ERR syntax error\r\n"))
+				return
+			}
+			if parts[i+1] != "0" {
+				conn.Write([]byte("-ERR DB index is out of range\r\n"))
+				return
+			}
+			i++
+		default:
+			conn.Write([]byte("-ERR syntax error\r\n"))
+			return
+		}
+	}
+	if src == dst {
+		conn.Write([]byte("-ERR source and destination objects are the same\r\n"))
+		return
+	}
+	obj := db.lookup(src)
+	if obj == nil {
+		conn.Write([]byte(":0\r\n"))
+		return
+	}
+	if db.lookup(dst) != nil && !replace {
+		conn.Write([]byte(":0\r\n"))
+		return
+	}
+	db.set(dst, obj.dup())
+	db.dirty++
+	conn.Write([]byte(":1\r\n"))
+}
+
+// handleKeys returns every live key matching a glob pattern. Expired keys
+// are skipped but left for lazy or active expiry to delete, since KEYS is a
+// read-only command.
+func handleKeys(conn net.Conn, parts []string, config *Config) {
+	pattern := parts[1]
+	var keys []string
+	// Like the scan, the lookup of a literal key skips expired keys without
+	// deleting them: KEYS is read-only and propagates nothing.
+	now := time.Now()
+	if !isGlobPattern(pattern) {
+		if obj, ok := db.dict.get(pattern); ok && !obj.expired(now) {
+			keys = append(keys, pattern)
+		}
+	} else {
+		allKeys := pattern == "*"
+		db.dict.each(func(key string, obj *redisObject) bool {
+			if !obj.expired(now) && (allKeys || stringMatch(pattern, key, false)) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+	}
+	conn.Write(encodeArray(keys))
+}
+
+func handleRandomKey(conn net.Conn, parts []string, config *Config) {
+	key, ok := db.randomKey()
+	if !ok {
+		conn.Write([]byte("$-1\r\n"))
+		return
+	}
+	fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(key), key)
+}
+
+func handleDBSize(conn net.Conn, parts []string, config *Config) {
+	fmt.Fprintf(conn, ":%d\r\n", db.dict.len())
+}
+
+// handleFlushAll serves both FLUSHALL and FLUSHDB, as there is only db 0.
+func handleFlushAll(conn net.Conn, parts []string, config *Config) {
+	if len(parts) > 2 {
+		conn.Write([]byte("-ERR syntax error\r\n"))
+		return
+	}
+	if len(parts) == 2 {
+		switch strings.ToUpper(parts[1]) {
+		case "ASYNC", "SYNC":
+		default:
+			conn.Write([]byte("-ERR syntax error\r\n"))
+			return
+		}
+	}
+	db.dirty += int64(db.flush()) + 1
+	conn.Write([]byte("+OK\r\n"))
+}
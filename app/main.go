@@ -5,15 +5,13 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type Entry struct {
-	Value  string
-	Expiry time.Time
-}
 type StreamEntry struct {
 	ID     string
 	Fields map[string]string
@@ -21,71 +19,154 @@ type StreamEntry struct {
 type clientState struct {
 	inMulti bool
 	queue   [][]string
+	// multiError is set when a command failed to queue; EXEC then aborts.
+	multiError bool
 }
-type Config struct {
-	Port         string
-	Role         string
-	MasterHost   string
-	MasterPort   string
-	replicaConns map[string]net.Conn
-	ReplicaMu    sync.Mutex
-	ReplOffset   int64
-	ReplicaAcks  map[string]int64
-	rdb_dir      string
-	rdb_filename string
+
+// client is a connection commands are read from. Handlers reply by writing
+// to it, so whether a reply goes out is decided here rather than by each
+// handler: regular clients always get one, while the link to this
+// replica's master applies the stream without answering it, and a replica
+// is only sent the replication stream once it issued PSYNC.
+//
+// Replies are queued rather than written, as handlers run with the
+// keyspace locked: handleConnection flushes them between commands, so a
+// client slow to read its replies only holds up itself. Under appendfsync
+// always this also means a write is on disk before its reply is sent.
+type client struct {
+	net.Conn
+	master  bool
+	replica bool
+	out     []byte
+	clientState
 }
 
-var (
-	store       = make(map[string]Entry)
-	mu          sync.RWMutex
-	list_store  = make(map[string][]string)
-	listLocks   = make(map[string]*sync.Mutex)
-	listLocksMu sync.Mutex
-)
+func (c *client) Write(p []byte) (int, error) {
+	if !c.master && !c.replica {
+		c.out = append(c.out, p...)
+	}
+	return len(p), nil
+}
 
-var (
-	streams   = make(map[string][]StreamEntry)
-	streamsMu sync.RWMutex
-)
+// flush writes the queued replies. The keyspace must not be locked.
+func (c *client) flush() error {
+	if len(c.out) == 0 {
+		return nil
+	}
+	_, err := c.Conn.Write(c.out)
+	c.out = c.out[:0]
+	if cap(c.out) > 64*1024 {
+		// Don't keep the buffer of a big reply around.
+		c.out = nil
+	}
+	return err
+}
 
-var WRITE_COMMANDS = map[string]bool{
-	"SET":    true,
-	"RPUSH":  true,
-	"LPUSH":  true,
-	"XADD":   true,
-	"INCR":   true,
-	"DEL":    true,
-	"LPUSHX": true,
-	"RPUSHX": true,
+// socket returns the network connection under conn, bypassing the reply
+// queue of a client.
+func socket(conn net.Conn) net.Conn {
+	if c, ok := conn.(*client); ok {
+		return c.Conn
+	}
+	return conn
+}
+
+type Config struct {
+	Port       string
+	Role       string
+	MasterHost string
+	MasterPort string
+	// replicas holds the replicas attached to this master by remote
+	// address; it is guarded by ReplicaMu.
+	replicas  map[string]*replica
+	ReplicaMu sync.Mutex
+	// ReplID names the replication history ReplOffset counts bytes of; a
+	// replica takes its master's. ReplID2 is the history this one
+	// continues, which partial resyncs may still name up to
+	// SecondReplOffset. These and the backlog are guarded by ReplicaMu.
+	ReplID           string
+	ReplID2          string
+	ReplOffset       int64
+	SecondReplOffset int64
+	ReplBacklogSize  int64
+	backlog          *replBacklog
+
+	// On a replica, the state of the link with the master, also guarded
+	// by ReplicaMu except masterLastIO, the time of the last read from
+	// the master in Unix nanoseconds. masterLinkGen counts the links
+	// started, so that the loop of a replaced one knows to stop.
+	masterLinkState       masterLinkState
+	masterLinkGen         int
+	masterConn            net.Conn
+	masterLinkDownSince   time.Time
+	masterLastIO          atomic.Int64
+	ReplicaServeStaleData bool
+	ReplicaReadOnly       bool
+	ReplPingReplicaPeriod int
+	ReplTimeout           int
+	rdb_dir               string
+	rdb_filename          string
+
+	ProtoMaxBulkLen         int64
+	Hz                      int
+	ActiveExpireEffort      int
+	SaveParams              []saveParam
+	StopWritesOnBgsaveError bool
+
+	AppendOnly               bool
+	AppendFilename           string
+	AppendDirname            string
+	AppendFsync              string
+	AOFLoadTruncated         bool
+	AutoAOFRewritePercentage int
+	AutoAOFRewriteMinSize    int64
 }
 
 func main() {
 	args := os.Args[1:]
 	config := Config{
-		Port:         "6379",
-		Role:         "master",
-		MasterHost:   "",
-		MasterPort:   "6379",
-		replicaConns: make(map[string]net.Conn),
-		ReplicaAcks:  make(map[string]int64),
+		Port:       "6379",
+		Role:       "master",
+		MasterHost: "",
+		MasterPort: "6379",
+		replicas:   make(map[string]*replica),
+		ReplID:     newReplicationID(),
+		ReplID2:    noReplicationID,
+
+		SecondReplOffset: -1,
+		ReplBacklogSize:  1024 * 1024,
+
+		ReplicaServeStaleData: true,
+		ReplicaReadOnly:       true,
+		ReplPingReplicaPeriod: 10,
+		ReplTimeout:           60,
+
+		ProtoMaxBulkLen:    defaultProtoMaxBulkLen,
+		Hz:                 10,
+		ActiveExpireEffort: 1,
+		rdb_dir:            ".",
+		rdb_filename:       "dump.rdb",
+
+		SaveParams:              defaultSaveParams,
+		StopWritesOnBgsaveError: true,
+
+		AppendFilename:           "appendonly.aof",
+		AppendDirname:            "appendonlydir",
+		AppendFsync:              "everysec",
+		AOFLoadTruncated:         true,
+		AutoAOFRewritePercentage: 100,
+		AutoAOFRewriteMinSize:    64 * 1024 * 1024,
 	}
-	for i := 0; i < len(args); i++ {
-		if args[i] == "--port" && i+1 < len(args) {
-			config.Port = args[i+1]
-			i++
-		} else if args[i] == "--replicaof" {
-			config.Role = "slave"
-			config.MasterHost, config.MasterPort = strings.Split(args[i+1], " ")[0], strings.Split(args[i+1], " ")[1]
-			i++
-			go connectToMaster(&config)
-		} else if args[i] == "--dir" && i+1 < len(args) {
-			config.rdb_dir = args[i+1]
-			i++
-		} else if args[i] == "--dbfilename" && i+1 < len(args) {
-			config.rdb_filename = args[i+1]
-			i++
-		}
+	db.config = &config
+	loadConfig(&config, args)
+	loadDataFromDisk(&config)
+	if config.Role == "slave" {
+		startReplicationLink(&config)
 	}
+	go activeExpireLoop(&config)
+	go saveCron(&config)
+	go aofCron(&config)
+	go replicationCron(&config)
 	ln := startServer(":" + config.Port)
 	defer ln.Close()
 	fmt.Printf("Listening on :%s\n", config.Port)
@@ -95,11 +176,7 @@ func main() {
 			fmt.Println(err)
 			continue
 		}
-		state := &clientState{
-			inMulti: false,
-			queue:   nil,
-		}
-		go handleConnection(conn, state, &config)
+		go handleConnection(&client{Conn: conn}, &config)
 	}
 }
 
@@ -111,108 +188,123 @@ func startServer(addr string) net.Listener {
 	return ln
 }
 
-func handleCommand(conn net.Conn, parts []string, config *Config) {
-	cmd := strings.ToUpper(parts[0])
-	switch cmd {
-	case "REPLCONF":
-		hadleReplconf(conn, parts, config)
-	case "PSYNC":
-		handlePsync(conn, parts, config)
-	case "PING":
-		handlePing(conn, config)
-	case "ECHO":
-		handleEcho(conn, parts)
-	case "SET":
-		handleSet(conn, parts, config)
-	case "GET":
-		handleGet(conn, parts)
-	case "RPUSH":
-		handleRPush(conn, parts, config)
-	case "LPUSH":
-		handleLPush(conn, parts, config)
-	case "LRANGE":
-		handleLRange(conn, parts)
-	case "LLEN":
-		handleLLen(conn, parts)
-	case "LPOP":
-		handleLPop(conn, parts)
-	case "BLPOP":
-		handleBLPop(conn, parts)
-	case "TYPE":
-		handleType(conn, parts)
-	case "XADD":
-		handleXAdd(conn, parts, config)
-	case "XRANGE":
-		handleXRange(conn, parts)
-	case "XREAD":
-		handleXRead(conn, parts)
-	case "INCR":
-		handleIncr(conn, parts, config)
-	case "INFO":
-		handleInfo(conn, parts, config)
-	case "WAIT":
-		handleWait(conn, parts, config)
-	case "CONFIG":
-		handleConfig(conn, parts,config)
-	case "KEYS":
-		handleKeys(conn, parts,config)
-	default:
-		conn.Write([]byte("-ERR unknown command\r\n"))
+// call runs cmd with the keyspace locked, so every command observes and
+// leaves a consistent dataset, and propagates writes that changed the dataset
+// in the order they were applied. Blocking commands release the lock while
+// waiting.
+func call(conn net.Conn, cmd *redisCommand, parts []string, config *Config) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	dirty := db.dirty
+	db.rewrite = nil
+	cmd.handler(conn, parts, config)
+	changed := db.dirty != dirty
+	if cmd.flags&cmdBlocking != 0 {
+		// Other clients' writes count while a blocking command waits, so
+		// it only changed the dataset if its handler set what to
+		// propagate: it is never propagated as is.
+		changed = db.rewrite != nil
+	}
+	if cmd.flags&cmdWrite != 0 && changed {
+		propagate(db.propagated(parts), config)
+	}
+}
+
+// propagate logs a write that changed the dataset to the AOF and, on a
+// master, sends it to the replicas. The keyspace must be locked. The
+// first command an EXEC propagates is preceded by MULTI.
+func propagate(parts []string, config *Config) {
+	if db.multiPending {
+		db.multiPending = false
+		propagate([]string{"MULTI"}, config)
+	}
+	feedAppendOnlyFile(parts, config)
+	if config.Role == "master" {
+		propagateToReplicas(parts, config)
 	}
 }
 
-func handleConnection(conn net.Conn, state *clientState, config *Config) {
-	defer conn.Close()
-	reader := bufio.NewReader(conn)
+func handleConnection(c *client, config *Config) {
+	defer c.Close()
+	defer removeReplica(c.Conn, config)
+	reader := bufio.NewReader(c)
 
 	for {
-		parts, err := readCommand(reader, conn)
+		if c.flush() != nil {
+			return
+		}
+		parts, err := readCommand(reader, c, config)
 		if err != nil {
+			c.flush()
 			return
 		}
 		if len(parts) == 0 {
 			continue
 		}
 
-		cmd := strings.ToUpper(parts[0])
-		if config.Role == "slave" {
-			fmt.Println("Slave received command:", cmd)
+		cmd, ok := checkCommand(c, parts)
+		if ok && (rejectWriteOnDiskError(c, cmd, config) || rejectStaleData(c, cmd, config) ||
+			rejectReadOnlyReplica(c, cmd, config)) {
+			ok = false
 		}
-		if state.inMulti {
-			if cmd == "EXEC" {
-				handleExec(conn, parts, state, config)
-				continue
-			}
-			if cmd == "MULTI" {
-				conn.Write([]byte("-ERR MULTI calls can not be nested\r\n"))
-				continue
+		if !ok {
+			if c.inMulti {
+				c.multiError = true
 			}
-			if cmd == "DISCARD" {
-				state.inMulti = false
-				state.queue = nil
-				conn.Write([]byte("+OK\r\n"))
-				continue
+			continue
+		}
+		if c.inMulti {
+			switch cmd.name {
+			case "exec":
+				handleExec(c, parts, &c.clientState, config)
+			case "multi":
+				c.Write([]byte("-ERR MULTI calls can not be nested\r\n"))
+			case "discard":
+				c.inMulti = false
+				c.multiError = false
+				c.queue = nil
+				c.Write([]byte("+OK\r\n"))
+			default:
+				c.queue = append(c.queue, parts)
+				c.Write([]byte("+QUEUED\r\n"))
 			}
-			state.queue = append(state.queue, parts)
-			conn.Write([]byte("+QUEUED\r\n"))
 			continue
 		}
-		switch cmd {
-		case "MULTI":
-			state.inMulti = true
-			state.queue = nil
-			conn.Write([]byte("+OK\r\n"))
-		case "EXEC":
-			handleExec(conn, parts, state, config)
-		case "DISCARD":
-			conn.Write([]byte("-ERR DISCARD without MULTI\r\n"))
+		switch cmd.name {
+		case "multi":
+			c.inMulti = true
+			c.multiError = false
+			c.queue = nil
+			c.Write([]byte("+OK\r\n"))
+		case "exec":
+			handleExec(c, parts, &c.clientState, config)
+		case "discard":
+			c.Write([]byte("-ERR DISCARD without MULTI\r\n"))
 		default:
-			handleCommand(conn, parts, config)
+			call(c, cmd, parts, config)
 		}
+	}
+}
 
-		if config.Role == "master" && WRITE_COMMANDS[cmd] {
-			propagateToReplicas(parts, config)
+// parseMemory parses a size such as "512mb" or "1gb" the way redis.conf does.
+func parseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	lower := strings.ToLower(s)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSuffix(lower, u.suffix), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return n * u.mul, nil
 		}
-
 	}
+	return strconv.ParseInt(lower, 10, 64)
 }
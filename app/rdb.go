@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+// loadRDB fills the keyspace from the RDB file in config's dir before the
+// server accepts connections. A missing file means an empty dataset; a
+// corrupt one stops the server, as starting with partial data would be
+// worse than not starting.
+func loadRDB(config *Config) {
+	filename := path.Join(config.rdb_dir, config.rdb_filename)
+	f, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		fmt.Println("Error opening RDB file:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	db.mu.Lock()
+	err = loadRDBFrom(f, config)
+	db.mu.Unlock()
+	if err != nil {
+		fmt.Printf("Error loading RDB file %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+}
+
+// loadRDBFrom decodes an RDB stream into the keyspace, which must be
+// locked. It reads exactly the RDB from r if r is a *bufio.Reader, so a
+// caller can go on reading what follows.
+func loadRDBFrom(r io.Reader, config *Config) error {
+	start := time.Now()
+	loaded, expired, skipped := 0, 0, 0
+	dec := rdb.NewDecoder(r)
+	err := dec.Decode(func(e *rdb.Entry) error {
+		// Only database 0 exists here.
+		if e.DB != 0 {
+			skipped++
+			return nil
+		}
+		obj := objectFromRDB(e)
+		// A master drops keys that expired while it was down; a replica
+		// keeps them until the master's DEL arrives.
+		if config.Role == "master" && obj.expired(start) {
+			expired++
+			return nil
+		}
+		db.set(e.Key, obj)
+		loaded++
+		return nil
+	})
+	rdbSave.lastLoadKeysLoaded = loaded
+	rdbSave.lastLoadKeysExpired = expired
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded RDB v%d: %d keys loaded, %d expired keys skipped, %d keys in other databases skipped, %.3f seconds\n",
+		dec.Version, loaded, expired, skipped, time.Since(start).Seconds())
+	return nil
+}
+
+// objectFromRDB converts a decoded RDB entry into a keyspace value.
+func objectFromRDB(e *rdb.Entry) *redisObject {
+	obj := &redisObject{}
+	if e.ExpireAt != 0 {
+		obj.expiry = time.UnixMilli(e.ExpireAt)
+	}
+	switch v := e.Value.(type) {
+	case string:
+		obj.typ, obj.value = typeString, v
+	case []string:
+		if e.Kind == rdb.KindSet {
+			set := newDict[struct{}]()
+			for _, m := range v {
+				set.set(m, struct{}{})
+			}
+			obj.typ, obj.value = typeSet, set
+		} else {
+			obj.typ, obj.value = typeList, v
+		}
+	case []rdb.ZMember:
+		zset := newDict[float64]()
+		for _, m := range v {
+			zset.set(m.Member, m.Score)
+		}
+		obj.typ, obj.value = typeZSet, zset
+	case map[string]string:
+		hash := newDict[string]()
+		for f, fv := range v {
+			hash.set(f, fv)
+		}
+		obj.typ, obj.value = typeHash, hash
+	case *rdb.Stream:
+		entries := make([]StreamEntry, len(v.Entries))
+		for i, se := range v.Entries {
+			fields := make(map[string]string, len(se.Fields)/2)
+			for j := 0; j+1 < len(se.Fields); j += 2 {
+				fields[se.Fields[j]] = se.Fields[j+1]
+			}
+			entries[i] = StreamEntry{ID: se.ID.String(), Fields: fields}
+		}
+		obj.typ, obj.value = typeStream, entries
+	}
+	return obj
+}
+
+// rdbSaveState tracks snapshots for SAVE, BGSAVE, LASTSAVE and INFO
+// persistence. It is guarded by db.mu like the keyspace.
+type rdbSaveState struct {
+	bgsaveInProgress  bool
+	bgsaveStart       time.Time
+	lastBgsaveTry     time.Time
+	lastBgsaveOK      bool
+	lastBgsaveSeconds int64 // -1 until a BGSAVE finishes
+	lastSave          time.Time
+	saves             int64
+	// dirtyAtLastSave is db.dirty when the last successful snapshot was
+	// taken; the difference is rdb_changes_since_last_save.
+	dirtyAtLastSave int64
+	// bgsaveScheduled is set by BGSAVE SCHEDULE while another save runs;
+	// saveCron starts the save once that one is done.
+	bgsaveScheduled bool
+
+	lastLoadKeysLoaded  int
+	lastLoadKeysExpired int
+}
+
+var rdbSave = &rdbSaveState{
+	lastBgsaveOK:      true,
+	lastBgsaveSeconds: -1,
+	lastSave:          time.Now(),
+}
+
+// snapshotEntry is one key as it was when a snapshot was taken.
+type snapshotEntry struct {
+	key    string
+	typ    valueType
+	value  interface{}
+	expiry time.Time
+}
+
+// snapshot copies the type, value and expiry of every key, which is enough
+// to write them out later without the lock: handlers never modify a value
+// in place, they store a new one in the object (appending past the end of a
+// list or stream only touches elements the snapshot does not see). The
+// keyspace must be locked.
+func (ks *keyspace) snapshot() []snapshotEntry {
+	entries := make([]snapshotEntry, 0, ks.dict.len())
+	ks.dict.each(func(key string, obj *redisObject) bool {
+		entries = append(entries, snapshotEntry{key, obj.typ, obj.value, obj.expiry})
+		return true
+	})
+	return entries
+}
+
+// writeRDB encodes a snapshot as a complete RDB file; aofBase marks it as
+// the base of an AOF.
+func writeRDB(w io.Writer, entries []snapshotEntry, aofBase bool) error {
+	enc := rdb.NewEncoder(w)
+	enc.WriteHeader()
+	enc.WriteAux("redis-ver", redisVersion)
+	enc.WriteAux("redis-bits", "64")
+	enc.WriteAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	enc.WriteAux("used-mem", strconv.FormatUint(m.HeapAlloc, 10))
+	if aofBase {
+		enc.WriteAux("aof-base", "1")
+	} else {
+		enc.WriteAux("aof-base", "0")
+	}
+	expires := 0
+	for _, e := range entries {
+		if !e.expiry.IsZero() {
+			expires++
+		}
+	}
+	enc.WriteSelectDB(0, len(entries), expires)
+	for _, e := range entries {
+		if err := enc.WriteEntry(entryToRDB(e)); err != nil {
+			return err
+		}
+	}
+	return enc.WriteEOF()
+}
+
+// entryToRDB is the inverse of objectFromRDB.
+func entryToRDB(e snapshotEntry) *rdb.Entry {
+	ent := &rdb.Entry{Key: e.key}
+	if !e.expiry.IsZero() {
+		ent.ExpireAt = e.expiry.UnixMilli()
+	}
+	switch v := e.value.(type) {
+	case string:
+		ent.Kind, ent.Value = rdb.KindString, v
+	case []string:
+		ent.Kind, ent.Value = rdb.KindList, v
+	case *dict[struct{}]:
+		members := make([]string, 0, v.len())
+		v.each(func(m string, _ struct{}) bool {
+			members = append(members, m)
+			return true
+		})
+		ent.Kind, ent.Value = rdb.KindSet, members
+	case *dict[float64]:
+		members := make([]rdb.ZMember, 0, v.len())
+		v.each(func(m string, score float64) bool {
+			members = append(members, rdb.ZMember{Member: m, Score: score})
+			return true
+		})
+		ent.Kind, ent.Value = rdb.KindZSet, members
+	case *dict[string]:
+		hash := make(map[string]string, v.len())
+		v.each(func(f, fv string) bool {
+			hash[f] = fv
+			return true
+		})
+		ent.Kind, ent.Value = rdb.KindHash, hash
+	case []StreamEntry:
+		st := &rdb.Stream{Entries: make([]rdb.StreamEntry, len(v))}
+		for i, se := range v {
+			ms, seq, _ := parseStreamID(se.ID)
+			fields := make([]string, 0, 2*len(se.Fields))
+			for _, f := range sortedFieldNames(se.Fields) {
+				fields = append(fields, f, se.Fields[f])
+			}
+			st.Entries[i] = rdb.StreamEntry{ID: rdb.StreamID{Ms: uint64(ms), Seq: uint64(seq)}, Fields: fields}
+		}
+		if len(st.Entries) > 0 {
+			st.LastID = st.Entries[len(st.Entries)-1].ID
+		}
+		ent.Kind, ent.Value = rdb.KindStream, st
+	}
+	return ent
+}
+
+// sortedFieldNames orders stream entry fields so that entries with the
+// same fields share the stream node's master fields in the RDB.
+func sortedFieldNames(fields map[string]string) []string {
+	names := make([]string, 0, len(fields))
+	for f := range fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// saveRDBFile writes a snapshot to a temporary file in the data directory
+// and renames it over the RDB file, so the file is always either the old
+// snapshot or the complete new one.
+func saveRDBFile(config *Config, entries []snapshotEntry) error {
+	tmp := path.Join(config.rdb_dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = writeRDB(f, entries, false)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path.Join(config.rdb_dir, config.rdb_filename))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(config.rdb_dir)
+	return nil
+}
+
+// syncDir fsyncs a directory, making a rename in it durable.
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
+
+// rdbSaveDone records a finished snapshot taken when db.dirty was dirty.
+// The keyspace must be locked.
+func rdbSaveDone(dirty int64) {
+	rdbSave.dirtyAtLastSave = dirty
+	rdbSave.lastSave = time.Now()
+	rdbSave.saves++
+}
+
+func handleSave(conn net.Conn, parts []string, config *Config) {
+	if rdbSave.bgsaveInProgress {
+		conn.Write([]byte("-ERR Background save already in progress\r\n"))
+		return
+	}
+	if err := saveRDBFile(config, db.snapshot()); err != nil {
+		fmt.Println("Error saving DB on disk:", err)
+		conn.Write([]byte("-ERR\r\n"))
+		return
+	}
+	rdbSaveDone(db.dirty)
+	fmt.Println("DB saved on disk")
+	conn.Write([]byte("+OK\r\n"))
+}
+
+func handleBGSave(conn net.Conn, parts []string, config *Config) {
+	schedule := len(parts) == 2 && strings.ToUpper(parts[1]) == "SCHEDULE"
+	if len(parts) > 2 || (len(parts) == 2 && !schedule) {
+		conn.Write([]byte("-ERR syntax error\r\n"))
+		return
+	}
+	if rdbSave.bgsaveInProgress {
+		if schedule {
+			rdbSave.bgsaveScheduled = true
+			conn.Write([]byte("+Background saving scheduled\r\n"))
+			return
+		}
+		conn.Write([]byte("-ERR Background save already in progress\r\n"))
+		return
+	}
+	startBGSave(config)
+	conn.Write([]byte("+Background saving started\r\n"))
+}
+
+// startBGSave takes a snapshot and writes it from a goroutine, so clients
+// are only held up for the copy of the keyspace's top level. The keyspace
+// must be locked.
+func startBGSave(config *Config) {
+	entries := db.snapshot()
+	dirty := db.dirty
+	rdbSave.bgsaveInProgress = true
+	rdbSave.bgsaveScheduled = false
+	rdbSave.bgsaveStart = time.Now()
+	rdbSave.lastBgsaveTry = rdbSave.bgsaveStart
+	fmt.Println("Background saving started")
+	go func() {
+		err := saveRDBFile(config, entries)
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		rdbSave.bgsaveInProgress = false
+		rdbSave.lastBgsaveSeconds = int64(time.Since(rdbSave.bgsaveStart).Seconds())
+		rdbSave.lastBgsaveOK = err == nil
+		if err != nil {
+			fmt.Println("Background saving error:", err)
+			return
+		}
+		rdbSaveDone(dirty)
+		fmt.Println("Background saving terminated with success")
+	}()
+}
+
+func handleLastSave(conn net.Conn, parts []string, config *Config) {
+	fmt.Fprintf(conn, ":%d\r\n", rdbSave.lastSave.Unix())
+}
+
+func persistenceInfo(config *Config) string {
+	status := "ok"
+	if !rdbSave.lastBgsaveOK {
+		status = "err"
+	}
+	inProgress, current := 0, int64(-1)
+	if rdbSave.bgsaveInProgress {
+		inProgress = 1
+		current = int64(time.Since(rdbSave.bgsaveStart).Seconds())
+	}
+	return fmt.Sprintf(
+		"loading:0\r\n"+
+			"rdb_changes_since_last_save:%d\r\n"+
+			"rdb_bgsave_in_progress:%d\r\n"+
+			"rdb_last_save_time:%d\r\n"+
+			"rdb_last_bgsave_status:%s\r\n"+
+			"rdb_last_bgsave_time_sec:%d\r\n"+
+			"rdb_current_bgsave_time_sec:%d\r\n"+
+			"rdb_saves:%d\r\n"+
+			"rdb_last_load_keys_expired:%d\r\n"+
+			"rdb_last_load_keys_loaded:%d\r\n",
+		db.dirty-rdbSave.dirtyAtLastSave, inProgress, rdbSave.lastSave.Unix(),
+		status, rdbSave.lastBgsaveSeconds, current, rdbSave.saves,
+		rdbSave.lastLoadKeysExpired, rdbSave.lastLoadKeysLoaded,
+	) + aofInfo(config)
+}
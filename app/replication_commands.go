@@ -2,113 +2,316 @@ package main
 
 import (
 	"bufio"
-	"encoding/hex"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-func connectToMaster(config *Config) (net.Conn, error) {
-	if config.Role != "slave" {
-		return nil, fmt.Errorf("not a slave configuration")
+// masterLinkState is where a replica stands in its link with the master.
+type masterLinkState int
+
+const (
+	replLinkConnect masterLinkState = iota // waiting to (re)connect
+	replLinkConnecting
+	replLinkHandshake
+	replLinkTransfer // receiving the RDB of a full resynchronization
+	replLinkConnected
+)
+
+const (
+	minReplBackoff = 100 * time.Millisecond
+	maxReplBackoff = 5 * time.Second
+)
+
+var errMasterChanged = errors.New("the master changed")
+
+// startReplicationLink starts the link with the master in
+// config.MasterHost and MasterPort, replacing any previous one.
+func startReplicationLink(config *Config) {
+	config.ReplicaMu.Lock()
+	defer config.ReplicaMu.Unlock()
+	gen := stopReplicationLinkLocked(config)
+	config.masterLinkState = replLinkConnect
+	config.masterLinkDownSince = time.Now()
+	go replicationLoop(config, gen)
+}
+
+// stopReplicationLinkLocked ends the current link with the master, if any:
+// it closes its connection, and its loop exits once it notices. It returns
+// the generation a new link must use. ReplicaMu must be held.
+func stopReplicationLinkLocked(config *Config) int {
+	config.masterLinkGen++
+	if config.masterConn != nil {
+		config.masterConn.Close()
+		config.masterConn = nil
+	}
+	return config.masterLinkGen
+}
+
+// masterLinkCurrent reports whether the link of generation gen is still
+// the one wanted.
+func masterLinkCurrent(config *Config, gen int) bool {
+	config.ReplicaMu.Lock()
+	defer config.ReplicaMu.Unlock()
+	return config.masterLinkGen == gen
+}
+
+// replicationLoop keeps a replica linked to its master: it connects, goes
+// through the handshake and the synchronization, then applies the stream
+// until the link breaks, and starts over after a delay that doubles with
+// every failed attempt. It returns once REPLICAOF replaces the link.
+func replicationLoop(config *Config, gen int) {
+	backoff := minReplBackoff
+	for {
+		synced, err := runMasterLink(config, gen)
+		config.ReplicaMu.Lock()
+		if config.masterLinkGen != gen {
+			config.ReplicaMu.Unlock()
+			return
+		}
+		config.masterConn = nil
+		if config.masterLinkDownSince.IsZero() {
+			config.masterLinkDownSince = time.Now()
+		}
+		config.masterLinkState = replLinkConnect
+		host, port := config.MasterHost, config.MasterPort
+		config.ReplicaMu.Unlock()
+		if synced {
+			backoff = minReplBackoff
+		}
+		fmt.Printf("Connection with master %s:%s lost or failed: %v; retrying in %v\n", host, port, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxReplBackoff)
 	}
-	conn, err := net.Dial("tcp", config.MasterHost+":"+config.MasterPort)
+}
+
+func setMasterLinkState(config *Config, state masterLinkState) {
+	config.ReplicaMu.Lock()
+	config.masterLinkState = state
+	config.ReplicaMu.Unlock()
+}
+
+// masterReader records the time of every read from the master, for
+// master_last_io_seconds_ago.
+type masterReader struct {
+	conn   net.Conn
+	config *Config
+}
+
+func (r masterReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.config.masterLastIO.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// runMasterLink makes one attempt at the link with the master, returning
+// once it breaks. synced reports whether it got as far as the stream.
+func runMasterLink(config *Config, gen int) (synced bool, err error) {
+	config.ReplicaMu.Lock()
+	config.masterLinkState = replLinkConnecting
+	host, port := config.MasterHost, config.MasterPort
+	config.ReplicaMu.Unlock()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 5*time.Second)
 	if err != nil {
 		fmt.Println("Error connecting to master: ", err.Error())
-		os.Exit(1)
+		return false, err
 	}
-	reader := bufio.NewReader(conn)
+	defer conn.Close()
+	config.ReplicaMu.Lock()
+	if config.masterLinkGen != gen {
+		config.ReplicaMu.Unlock()
+		return false, errMasterChanged
+	}
+	config.masterConn = conn
+	config.ReplicaMu.Unlock()
+	fmt.Printf("Connected to master %s:%s\n", host, port)
+	link := &client{Conn: conn, master: true}
+	config.masterLastIO.Store(time.Now().UnixNano())
+	reader := bufio.NewReader(masterReader{conn, config})
 
+	setMasterLinkState(config, replLinkHandshake)
 	if err := sendPing(conn, reader); err != nil {
-		conn.Close()
-		return nil, err
+		return false, err
 	}
 	if err := sendReplconfListeningPort(conn, reader, config.Port); err != nil {
-		conn.Close()
-		return nil, err
+		return false, err
 	}
 	if err := sendReplconfCapa(conn, reader); err != nil {
-		conn.Close()
-		return nil, err
+		return false, err
 	}
-	if err := sendPsync(conn, reader); err != nil {
-		conn.Close()
-		return nil, err
+	if err := sendPsync(conn, reader, gen, config); err != nil {
+		return false, err
 	}
-	defer conn.Close()
+	config.ReplicaMu.Lock()
+	config.masterLinkState = replLinkConnected
+	config.masterLinkDownSince = time.Time{}
+	config.ReplicaMu.Unlock()
+
+	// block holds a MULTI ... EXEC transaction until its EXEC arrives, so
+	// that it is applied at once; blockSize is its size in the stream.
+	var block [][]string
+	var blockSize int
 	for {
-		parts, size, err := ParseRESP(reader)
+		parts, size, err := readRequest(reader, 0)
 		if err != nil {
 			fmt.Println("Error reading RESP from master:", err)
-			conn.Close()
-			return nil, err
+			return true, err
 		}
 		if len(parts) == 0 {
 			continue
 		}
-		if strings.ToUpper(parts[0]) == "REPLCONF" && len(parts) > 1 && strings.ToUpper(parts[1]) == "GETACK" {
-			config.ReplicaMu.Lock()
-			offset := config.ReplOffset
-			config.ReplicaMu.Unlock()
-			ack := strconv.FormatInt(offset, 10)
-			fmt.Fprintf(conn, "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%s\r\n", len(ack), ack)
+		name := strings.ToUpper(parts[0])
+		if block != nil || name == "MULTI" {
+			block = append(block, parts)
+			blockSize += size
+			if name != "EXEC" {
+				continue
+			}
+		}
+		// The command is applied and counted in one go under the lock, so
+		// that REPLICAOF, which takes it too, sees either both or neither
+		// and nothing of this link past its own change.
+		db.mu.Lock()
+		if !masterLinkCurrent(config, gen) {
+			db.mu.Unlock()
+			return true, errMasterChanged
+		}
+		if block != nil {
+			applyBlockFromMaster(link, block[1:len(block)-1], config)
+			applied := block
+			block, size, blockSize = nil, blockSize, 0
 			config.ReplicaMu.Lock()
 			config.ReplOffset += int64(size)
+			if config.backlog != nil {
+				for _, parts := range applied {
+					config.backlog.write([]byte(buildRespArray(parts)))
+				}
+			}
 			config.ReplicaMu.Unlock()
+			db.mu.Unlock()
 			continue
 		}
-
-		handleCommand(conn, parts, config)
+		var ack string
+		if name == "REPLCONF" && len(parts) > 1 && strings.ToUpper(parts[1]) == "GETACK" {
+			config.ReplicaMu.Lock()
+			ack = strconv.FormatInt(config.ReplOffset, 10)
+			config.ReplicaMu.Unlock()
+		} else {
+			applyFromMaster(link, parts, config)
+		}
+		// The stream is kept in the backlog as the master produced it, so
+		// this replica can resume it, or serve it once promoted.
 		config.ReplicaMu.Lock()
 		config.ReplOffset += int64(size)
+		if config.backlog != nil {
+			config.backlog.write([]byte(buildRespArray(parts)))
+		}
 		config.ReplicaMu.Unlock()
+		db.mu.Unlock()
+		if ack != "" {
+			// The acknowledgement is the one thing the master is sent, so
+			// it bypasses the link's client; like every reply, it is
+			// written with the keyspace unlocked.
+			fmt.Fprintf(conn, "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%s\r\n", len(ack), ack)
+		}
 	}
 }
 
-// ParseRESP parses a RESP array from the reader and returns a slice of strings.
-func ParseRESP(reader *bufio.Reader) ([]string, int, error) {
-	total := 0
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, total, err
+// rejectStaleData replies with MASTERDOWN and returns true if this is a
+// replica whose link with the master is not up, replica-serve-stale-data
+// is off and cmd is not one of the commands allowed regardless.
+func rejectStaleData(conn net.Conn, cmd *redisCommand, config *Config) bool {
+	if cmd.flags&cmdStale != 0 {
+		return false
 	}
-	total += len(line)
-	line = strings.TrimSpace(line)
-	if len(line) == 0 || line[0] != '*' {
-		return nil, total, fmt.Errorf("expected RESP array, got: %s", line)
+	config.ReplicaMu.Lock()
+	stale := config.Role == "slave" && config.masterLinkState != replLinkConnected && !config.ReplicaServeStaleData
+	config.ReplicaMu.Unlock()
+	if stale {
+		conn.Write([]byte("-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n"))
 	}
-	numElements, err := strconv.Atoi(line[1:])
-	if err != nil {
-		return nil, total, fmt.Errorf("invalid array length: %v", err)
+	return stale
+}
+
+// replicaReadOnly reports whether this is a replica that refuses writes
+// from its clients.
+func replicaReadOnly(config *Config) bool {
+	config.ReplicaMu.Lock()
+	defer config.ReplicaMu.Unlock()
+	return config.Role == "slave" && config.ReplicaReadOnly
+}
+
+// rejectReadOnlyReplica replies with READONLY and returns true if cmd is a
+// write sent by a client to a read-only replica. Only client connections
+// go through this check: the stream from the master is applied by
+// applyFromMaster on the link's own connection.
+func rejectReadOnlyReplica(conn net.Conn, cmd *redisCommand, config *Config) bool {
+	if cmd.flags&cmdWrite == 0 || !replicaReadOnly(config) {
+		return false
+	}
+	conn.Write([]byte("-READONLY You can't write against a read only replica.\r\n"))
+	return true
+}
+
+// applyFromMaster runs a command received on the replication stream, and
+// logs it to the AOF if it changed the dataset. The keyspace must be
+// locked.
+func applyFromMaster(conn net.Conn, parts []string, config *Config) {
+	if argv := runFromMaster(conn, parts, config); argv != nil {
+		feedAppendOnlyFile(argv, config)
 	}
-	parts := make([]string, 0, numElements)
-	for i := 0; i < numElements; i++ {
-		// Read bulk string header
-		bulkHeader, err := reader.ReadString('\n')
-		if err != nil {
-			return nil, total, err
-		}
-		total += len(bulkHeader)
-		bulkHeader = strings.TrimSpace(bulkHeader)
-		if len(bulkHeader) == 0 || bulkHeader[0] != '$' {
-			return nil, total, fmt.Errorf("expected bulk string, got: %s", bulkHeader)
-		}
-		strLen, err := strconv.Atoi(bulkHeader[1:])
-		if err != nil {
-			return nil, total, fmt.Errorf("invalid bulk string length: %v", err)
+}
+
+// applyBlockFromMaster runs the commands of a transaction received on the
+// replication stream, and logs those that changed the dataset to the AOF
+// as a transaction too. The keyspace must be locked.
+func applyBlockFromMaster(conn net.Conn, queue [][]string, config *Config) {
+	db.inExec = true
+	logged := false
+	for _, parts := range queue {
+		argv := runFromMaster(conn, parts, config)
+		if argv == nil {
+			continue
 		}
-		// Read the actual string
-		str := make([]byte, strLen+2) // +2 for \r\n
-		if _, err := io.ReadFull(reader, str); err != nil {
-			return nil, total, err
+		if !logged {
+			feedAppendOnlyFile([]string{"MULTI"}, config)
+			logged = true
 		}
-		total += len(str)
-		parts = append(parts, string(str[:strLen]))
+		feedAppendOnlyFile(argv, config)
+	}
+	if logged {
+		feedAppendOnlyFile([]string{"EXEC"}, config)
 	}
-	return parts, total, nil
+	db.inExec = false
+}
+
+// runFromMaster runs a command received on the replication stream and
+// returns the command to log if it changed the dataset, nil otherwise.
+func runFromMaster(conn net.Conn, parts []string, config *Config) []string {
+	cmd, ok := checkCommand(conn, parts)
+	if !ok || cmd.handler == nil {
+		return nil
+	}
+	db.masterLink = true
+	dirty := db.dirty
+	db.rewrite = nil
+	cmd.handler(conn, parts, config)
+	db.masterLink = false
+	if db.dirty == dirty {
+		return nil
+	}
+	return db.propagated(parts)
 }
 
 func sendPing(conn net.Conn, reader *bufio.Reader) error {
@@ -157,16 +360,50 @@ func sendReplconfCapa(conn net.Conn, reader *bufio.Reader) error {
 	return nil
 }
 
-func sendPsync(conn net.Conn, reader *bufio.Reader) error {
-	fmt.Fprintf(conn, "*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n")
+// sendPsync asks the master to resume the stream where this replica's
+// backlog ends, or for a full resynchronization when it has none, and
+// then loads the RDB the master sends for the latter.
+func sendPsync(conn net.Conn, reader *bufio.Reader, gen int, config *Config) error {
+	replID, offset := "?", "-1"
+	config.ReplicaMu.Lock()
+	if config.backlog != nil {
+		replID, offset = config.ReplID, strconv.FormatInt(config.ReplOffset+1, 10)
+	}
+	config.ReplicaMu.Unlock()
+	fmt.Fprintf(conn, "*3\r\n$5\r\nPSYNC\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(replID), replID, len(offset), offset)
 	line, err := reader.ReadString('\n')
 	if err != nil {
 		fmt.Println("Error reading PSYNC reply from master: ", err)
 		return err
 	}
-	if !strings.HasPrefix(strings.TrimSpace(line), "+FULLRESYNC") {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "+CONTINUE" {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if !masterLinkCurrent(config, gen) {
+			return errMasterChanged
+		}
+		config.ReplicaMu.Lock()
+		defer config.ReplicaMu.Unlock()
+		if len(fields) > 1 && fields[1] != config.ReplID {
+			// The master moved to a new history continuing ours, as when
+			// it was promoted: follow it, still accepting our own
+			// replicas' resyncs against the old one.
+			shiftReplicationID(config, fields[1])
+			fmt.Printf("Master replication ID changed to %s\n", config.ReplID)
+		}
+		fmt.Println("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+		return nil
+	}
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
 		return fmt.Errorf("unexpected response from master: %s", line)
 	}
+	masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offset in FULLRESYNC: %s", fields[2])
+	}
+	fmt.Printf("Full resync from master: %s:%d\n", fields[1], masterOffset)
+	setMasterLinkState(config, replLinkTransfer)
 	// Next the master will send a bulk header for the RDB: $<len>\r\n
 	header, err := reader.ReadString('\n')
 	if err != nil {
@@ -178,27 +415,302 @@ func sendPsync(conn net.Conn, reader *bufio.Reader) error {
 		return fmt.Errorf("expected bulk header for RDB, got: %s", header)
 	}
 	sizeStr := strings.TrimPrefix(header, "$")
-	size, err := strconv.Atoi(sizeStr)
-	if err != nil {
-		return fmt.Errorf("invalid RDB size: %v", err)
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid RDB size: %s", sizeStr)
 	}
 
-	// Read the exact number of bytes for the RDB file
-	rdb := make([]byte, size)
-	if _, err := io.ReadFull(reader, rdb); err != nil {
+	// The RDB is received into a temporary file rather than memory, and
+	// loaded once complete, so the dataset is not locked during the
+	// transfer.
+	db.mu.Lock()
+	tmp := path.Join(config.rdb_dir, fmt.Sprintf("temp-%d.%d.rdb", os.Getpid(), time.Now().Unix()))
+	db.mu.Unlock()
+	f, err := os.Create(tmp)
+	if err != nil {
+		fmt.Println("Opening the temp file needed for MASTER <-> REPLICA synchronization:", err)
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	if _, err := io.CopyN(f, reader, size); err != nil {
 		fmt.Println("Error reading RDB bytes from master:", err)
 		return err
 	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fmt.Printf("MASTER <-> REPLICA sync: received %d bytes\n", size)
+	return loadMasterRDB(bufio.NewReader(f), fields[1], masterOffset, gen, config)
+}
+
+// loadMasterRDB replaces the dataset with the RDB received from the master,
+// read from r, whose replication stream continues from offset of history
+// replID. The backlog restarts there, and an AOF is rewritten from the new
+// dataset, as what it logged so far no longer applies.
+func loadMasterRDB(r io.Reader, replID string, offset int64, gen int, config *Config) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !masterLinkCurrent(config, gen) {
+		return errMasterChanged
+	}
+	fmt.Println("MASTER <-> REPLICA sync: Flushing old data")
+	db.flush()
+	fmt.Println("MASTER <-> REPLICA sync: Loading DB in memory")
+	if err := loadRDBFrom(r, config); err != nil {
+		fmt.Println("Failed trying to load the MASTER synchronization DB:", err)
+		db.flush()
+		return err
+	}
+	config.ReplicaMu.Lock()
+	config.ReplID = replID
+	clearReplicationID2(config)
+	config.ReplOffset = offset
+	config.backlog = newReplBacklog(config.ReplBacklogSize, offset)
+	config.ReplicaMu.Unlock()
+	// Loading counts as activity on the link, however long it took.
+	config.masterLastIO.Store(time.Now().UnixNano())
+	if aofLog.file != nil {
+		stopAppendOnly(config)
+		if err := startAppendOnly(config); err != nil {
+			fmt.Println("Failed restarting the AOF after the sync:", err)
+		}
+	}
+	fmt.Println("MASTER <-> REPLICA sync: Finished with success")
 	return nil
 }
 
-func handleInfo(conn net.Conn, parts []string, config *Config) {
-	info := fmt.Sprintf(
-		"# Replication\r\nrole:%s\r\nmaster_replid:8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb\r\nmaster_repl_offset:0\r\n",
-		config.Role,
-	)
-	conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)))
+// replicationInfo reports the role, the state of the link with the master
+// on a replica, the replication IDs and offsets, and the state of the
+// backlog.
+func replicationInfo(config *Config) string {
+	config.ReplicaMu.Lock()
+	defer config.ReplicaMu.Unlock()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "role:%s\r\n", config.Role)
+	if config.Role == "slave" {
+		status, lastIO, syncing := "down", int64(-1), 0
+		if config.masterLinkState == replLinkConnected {
+			status = "up"
+			lastIO = int64(time.Since(time.Unix(0, config.masterLastIO.Load())).Seconds())
+		}
+		if config.masterLinkState == replLinkTransfer {
+			syncing = 1
+		}
+		readOnly := 0
+		if config.ReplicaReadOnly {
+			readOnly = 1
+		}
+		fmt.Fprintf(&sb,
+			"master_host:%s\r\n"+
+				"master_port:%s\r\n"+
+				"master_link_status:%s\r\n"+
+				"master_last_io_seconds_ago:%d\r\n"+
+				"master_sync_in_progress:%d\r\n"+
+				"slave_repl_offset:%d\r\n"+
+				"slave_read_only:%d\r\n",
+			config.MasterHost, config.MasterPort, status, lastIO, syncing, config.ReplOffset,
+			readOnly,
+		)
+		if status == "down" {
+			downSince := int64(-1)
+			if !config.masterLinkDownSince.IsZero() {
+				downSince = int64(time.Since(config.masterLinkDownSince).Seconds())
+			}
+			fmt.Fprintf(&sb, "master_link_down_since_seconds:%d\r\n", downSince)
+		}
+	} else {
+		var addrs []string
+		for addr, r := range config.replicas {
+			if r.state != replicaHandshake {
+				addrs = append(addrs, addr)
+			}
+		}
+		sort.Strings(addrs)
+		fmt.Fprintf(&sb, "connected_slaves:%d\r\n", len(addrs))
+		for i, addr := range addrs {
+			r := config.replicas[addr]
+			ip, _, _ := net.SplitHostPort(addr)
+			port := r.listeningPort
+			if port == "" {
+				port = "0"
+			}
+			state := "send_bulk"
+			if r.state == replicaOnline {
+				state = "online"
+			}
+			fmt.Fprintf(&sb, "slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d\r\n",
+				i, ip, port, state, r.ackOffset, int64(time.Since(r.lastAck).Seconds()))
+		}
+	}
+	fmt.Fprintf(&sb, "master_replid:%s\r\nmaster_replid2:%s\r\n", config.ReplID, config.ReplID2)
+	fmt.Fprintf(&sb, "master_repl_offset:%d\r\nsecond_repl_offset:%d\r\n", config.ReplOffset, config.SecondReplOffset)
+	var active, first, histlen int64
+	if b := config.backlog; b != nil {
+		active, first, histlen = 1, b.offset, int64(b.histlen)
+	}
+	fmt.Fprintf(&sb, "repl_backlog_active:%d\r\nrepl_backlog_size:%d\r\n", active, config.ReplBacklogSize)
+	fmt.Fprintf(&sb, "repl_backlog_first_byte_offset:%d\r\nrepl_backlog_histlen:%d\r\n", first, histlen)
+	return sb.String()
+}
+
+// replicaState tracks a replica through a full resynchronization: it is
+// sent the RDB after PSYNC, then the commands written meanwhile, and from
+// then on the replication stream as it is produced.
+type replicaState int
+
+const (
+	replicaHandshake replicaState = iota
+	replicaSendingRDB
+	replicaOnline
+)
+
+// replica is a replica attached to this master. Only its writer
+// goroutine writes to conn: the stream is fed to buf, under ReplicaMu,
+// and the writer sends it without the keyspace locked, so a replica slow
+// to read only falls behind itself.
+type replica struct {
+	conn          net.Conn
+	listeningPort string
+	state         replicaState
+	// buf holds the stream the writer has yet to send, including all of
+	// it since the snapshot while the RDB is being transferred.
+	buf []byte
+	// wake is signalled, with ReplicaMu, when buf grows or the replica is
+	// dropped, which sets closed.
+	wake      *sync.Cond
+	closed    bool
+	ackOffset int64
+	// lastAck is when the replica last acknowledged its offset, or
+	// registered or came online; replicationCron drops it after
+	// repl-timeout without one.
+	lastAck time.Time
+}
+
+// handleReplicaOf changes the role of the server at runtime. REPLICAOF
+// host port makes it a replica of that master: its own replicas are
+// disconnected so they resync, and the new link first tries to resume the
+// stream of its own history, which only a master continuing it accepts;
+// otherwise the full resynchronization replaces the dataset. REPLICAOF NO
+// ONE promotes a replica, keeping its data and backlog, and starts a new
+// history while accepting partial resyncs against the one it followed, so
+// replicas of the same master can switch to it without a full copy.
+func handleReplicaOf(conn net.Conn, parts []string, config *Config) {
+	if strings.EqualFold(parts[1], "no") && strings.EqualFold(parts[2], "one") {
+		if config.Role == "slave" {
+			config.ReplicaMu.Lock()
+			stopReplicationLinkLocked(config)
+			config.Role = "master"
+			shiftReplicationID(config, newReplicationID())
+			if config.backlog == nil {
+				config.backlog = newReplBacklog(config.ReplBacklogSize, config.ReplOffset)
+			}
+			fmt.Printf("Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s\n",
+				config.ReplID2, config.SecondReplOffset, config.ReplID)
+			config.ReplicaMu.Unlock()
+			fmt.Printf("MASTER MODE enabled (user request from '%s')\n", conn.RemoteAddr())
+		}
+		conn.Write([]byte("+OK\r\n"))
+		return
+	}
+	host, port := parts[1], parts[2]
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		conn.Write([]byte("-ERR Invalid master port\r\n"))
+		return
+	}
+	config.ReplicaMu.Lock()
+	if config.Role == "slave" && config.MasterHost == host && config.MasterPort == port {
+		config.ReplicaMu.Unlock()
+		conn.Write([]byte("+OK Already connected to specified master\r\n"))
+		return
+	}
+	for addr, r := range config.replicas {
+		dropReplica(addr, r, config)
+	}
+	config.Role = "slave"
+	config.MasterHost, config.MasterPort = host, port
+	config.ReplicaMu.Unlock()
+	startReplicationLink(config)
+	fmt.Printf("REPLICAOF %s:%s enabled (user request from '%s')\n", host, port, conn.RemoteAddr())
+	conn.Write([]byte("+OK\r\n"))
+}
+
+// replicationCron runs the periodic work of replication once a second. A
+// master sends PING on the stream every repl-ping-replica-period seconds,
+// so replicas can tell a quiet master from a dead link, and drops the
+// replicas that have not acknowledged anything for repl-timeout seconds. A
+// replica acknowledges its offset, which keeps WAIT and the lag reported
+// by the master current, and drops a link that was silent for as long.
+func replicationCron(config *Config) {
+	var lastPing time.Time
+	for {
+		time.Sleep(time.Second)
+		now := time.Now()
+		var ackConn net.Conn
+		var ack string
+		db.mu.Lock()
+		period := time.Duration(config.ReplPingReplicaPeriod) * time.Second
+		timeout := time.Duration(config.ReplTimeout) * time.Second
+		config.ReplicaMu.Lock()
+		if config.Role == "master" {
+			// Under the keyspace lock, so the PING never lands inside a
+			// transaction's block.
+			if len(config.replicas) > 0 && now.Sub(lastPing) >= period {
+				feedReplicationStream([]byte("*1\r\n$4\r\nPING\r\n"), config)
+				lastPing = now
+			}
+			for addr, r := range config.replicas {
+				if r.state == replicaOnline && now.Sub(r.lastAck) > timeout {
+					fmt.Printf("Disconnecting timedout replica: %s\n", addr)
+					dropReplica(addr, r, config)
+				}
+			}
+		} else if config.masterConn != nil {
+			lastIO := time.Unix(0, config.masterLastIO.Load())
+			if now.Sub(lastIO) > timeout {
+				fmt.Println("MASTER timeout: no data nor PING received...")
+				config.masterConn.Close()
+			} else if config.masterLinkState == replLinkConnected {
+				ackConn, ack = config.masterConn, strconv.FormatInt(config.ReplOffset, 10)
+			}
+		}
+		config.ReplicaMu.Unlock()
+		db.mu.Unlock()
+		if ackConn != nil {
+			fmt.Fprintf(ackConn, "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%s\r\n", len(ack), ack)
+		}
+	}
+}
+
+// removeReplica forgets the replica on conn, if it is one, once the
+// connection ends.
+func removeReplica(conn net.Conn, config *Config) {
+	addr := conn.RemoteAddr().String()
+	config.ReplicaMu.Lock()
+	defer config.ReplicaMu.Unlock()
+	if r := config.replicas[addr]; r != nil && r.conn == conn {
+		dropReplica(addr, r, config)
+		fmt.Printf("Connection with replica %s lost.\n", addr)
+	}
+}
+
+// newReplica registers conn, a client connection, as a replica.
+// ReplicaMu must be held.
+func newReplica(conn net.Conn, config *Config) *replica {
+	r := &replica{conn: socket(conn), wake: sync.NewCond(&config.ReplicaMu), lastAck: time.Now()}
+	config.replicas[conn.RemoteAddr().String()] = r
+	return r
+}
 
+// dropReplica closes the connection of the replica at addr, which stops
+// its writer, and forgets it. ReplicaMu must be held.
+func dropReplica(addr string, r *replica, config *Config) {
+	r.conn.Close()
+	r.closed = true
+	r.wake.Signal()
+	if config.replicas[addr] == r {
+		delete(config.replicas, addr)
+	}
 }
 
 func hadleReplconf(conn net.Conn, parts []string, config *Config) {
@@ -206,12 +718,7 @@ func hadleReplconf(conn net.Conn, parts []string, config *Config) {
 		conn.Write([]byte("-ERR wrong number of arguments for 'replconf' command\r\n"))
 		return
 	}
-	// if config.Role == "slave" && strings.ToUpper(parts[1]) == "GETACK" {
-	// 	conn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$1\r\n0\r\n"))
-	// 	return
-	// }
 	if config.Role != "master" {
-		// conn.Write([]byte("-ERR replconf is only supported in master mode\r\n"))
 		return
 	}
 	if parts[1] == "listening-port" {
@@ -224,20 +731,19 @@ func hadleReplconf(conn net.Conn, parts []string, config *Config) {
 			conn.Write([]byte("-ERR invalid port number\r\n"))
 			return
 		}
-		remote := conn.RemoteAddr().String()
-		fmt.Printf("New replica connected: %s (listening-port=%s)\n", remote, port)
+		fmt.Printf("New replica connected: %s (listening-port=%s)\n", conn.RemoteAddr(), port)
 		config.ReplicaMu.Lock()
-		config.replicaConns[remote] = conn
-		// Initialize the replica's ACK for WAIT commands.
-		config.ReplicaAcks[remote] = 0
+		newReplica(conn, config).listeningPort = port
 		config.ReplicaMu.Unlock()
 	}
 	if strings.ToUpper(parts[1]) == "ACK" && len(parts) > 2 {
 		offset, err := strconv.ParseInt(parts[2], 10, 64)
 		if err == nil {
-			addr := conn.RemoteAddr().String()
 			config.ReplicaMu.Lock()
-			config.ReplicaAcks[addr] = offset
+			if r := config.replicas[conn.RemoteAddr().String()]; r != nil {
+				r.ackOffset = offset
+				r.lastAck = time.Now()
+			}
 			config.ReplicaMu.Unlock()
 		}
 		return
@@ -245,8 +751,14 @@ func hadleReplconf(conn net.Conn, parts []string, config *Config) {
 	conn.Write([]byte("+OK\r\n"))
 }
 
+// handlePsync resumes the stream of a replica that names a replication
+// history this master knows, from an offset still in the backlog, or
+// starts a full resynchronization. The keyspace is snapshotted here, under
+// the lock, so that the RDB and the offset it is sent with describe the
+// same point of the stream; every write from then on is buffered for the
+// replica until the RDB has been transferred.
 func handlePsync(conn net.Conn, parts []string, config *Config) {
-	if len(parts) < 3 || parts[1] != "?" || parts[2] != "-1" {
+	if len(parts) != 3 {
 		conn.Write([]byte("-ERR wrong number of arguments for 'psync' command\r\n"))
 		return
 	}
@@ -255,15 +767,125 @@ func handlePsync(conn net.Conn, parts []string, config *Config) {
 		conn.Write([]byte("-ERR psync is only supported in master mode\r\n"))
 		return
 	}
-	conn.Write([]byte("+FULLRESYNC 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb 0\r\n"))
-	empty_rdb_file := "524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2"
-	rdbBytes, err := hex.DecodeString(empty_rdb_file)
-	if err != nil {
-		fmt.Println("failed to decode rdb hex:", err)
-		conn.Write([]byte("-ERR internal error\r\n"))
+	remote := conn.RemoteAddr().String()
+	config.ReplicaMu.Lock()
+	defer config.ReplicaMu.Unlock()
+	r := config.replicas[remote]
+	if r == nil || r.conn != socket(conn) {
+		r = newReplica(conn, config)
+	}
+	if r.state != replicaHandshake {
+		// Already syncing: the writer owns the connection.
+		return
+	}
+	// From now on the connection carries the replication stream, sent by
+	// the replica's writer, and replies to what the replica sends are
+	// dropped.
+	if c, ok := conn.(*client); ok {
+		c.replica = true
+	}
+	if tryPartialResync(r, parts[1], parts[2], config) {
 		return
 	}
-	fmt.Fprintf(conn, "$%d\r\n%s", len(rdbBytes), rdbBytes)
+
+	if config.backlog == nil {
+		// A new backlog starts a new history: nothing before it can be
+		// resumed.
+		changeReplicationID(config)
+		clearReplicationID2(config)
+		config.backlog = newReplBacklog(config.ReplBacklogSize, config.ReplOffset)
+		fmt.Printf("Replication backlog created, my new replication IDs are '%s' and '%s'\n", config.ReplID, config.ReplID2)
+	}
+	entries := db.snapshot()
+	r.state = replicaSendingRDB
+	r.buf = nil
+	reply := fmt.Sprintf("+FULLRESYNC %s %d\r\n", config.ReplID, config.ReplOffset)
+	fmt.Printf("Starting full resync with replica %s at offset %d (%d keys)\n", remote, config.ReplOffset, len(entries))
+	go replicaWriter(r, []byte(reply), entries, config)
+}
+
+// tryPartialResync accepts a PSYNC naming the current replication ID, or
+// the previous one up to the offset where it ended, and an offset the
+// backlog still holds; it then has +CONTINUE and the missing part of the
+// stream sent. ReplicaMu must be held.
+func tryPartialResync(r *replica, replID, offsetArg string, config *Config) bool {
+	offset, err := strconv.ParseInt(offsetArg, 10, 64)
+	if err != nil || replID == "?" {
+		return false
+	}
+	addr := r.conn.RemoteAddr().String()
+	if replID != config.ReplID && (replID != config.ReplID2 || offset > config.SecondReplOffset) {
+		if replID != config.ReplID2 {
+			fmt.Printf("Partial resynchronization not accepted: Replication ID mismatch (Replica asked for '%s', my replication IDs are '%s' and '%s')\n",
+				replID, config.ReplID, config.ReplID2)
+		} else {
+			fmt.Printf("Partial resynchronization not accepted: Requested offset for second ID was %d, but I can reply up to %d\n",
+				offset, config.SecondReplOffset)
+		}
+		return false
+	}
+	if config.backlog == nil || !config.backlog.covers(offset) {
+		fmt.Printf("Unable to partial resync with replica %s for lack of backlog (Replica request was: %d)\n", addr, offset)
+		return false
+	}
+	missing := config.backlog.from(offset)
+	reply := append([]byte("+CONTINUE "+config.ReplID+"\r\n"), missing...)
+	r.state = replicaOnline
+	r.lastAck = time.Now()
+	r.buf = nil
+	go replicaWriter(r, reply, nil, config)
+	fmt.Printf("Partial resynchronization request from %s accepted. Sending %d bytes of backlog starting from offset %d.\n",
+		addr, len(missing), offset)
+	return true
+}
+
+// replicaWriter sends a replica everything meant for it: the reply to its
+// PSYNC, then for a full resynchronization the RDB of the snapshot entries
+// and the stream written meanwhile, putting it online, and from then on
+// the stream as it is fed to its buffer. It stops when the replica is
+// dropped, or drops it when a write fails.
+func replicaWriter(r *replica, reply []byte, entries []snapshotEntry, config *Config) {
+	addr := r.conn.RemoteAddr().String()
+	_, err := r.conn.Write(reply)
+	if err == nil && r.state == replicaSendingRDB {
+		var payload bytes.Buffer
+		err = writeRDB(&payload, entries, false)
+		if err == nil {
+			_, err = fmt.Fprintf(r.conn, "$%d\r\n", payload.Len())
+		}
+		if err == nil {
+			_, err = r.conn.Write(payload.Bytes())
+		}
+		if err == nil {
+			fmt.Printf("Synchronization with replica %s succeeded (%d bytes)\n", addr, payload.Len())
+		}
+	}
+
+	config.ReplicaMu.Lock()
+	defer config.ReplicaMu.Unlock()
+	if err == nil && r.state == replicaSendingRDB {
+		// What was buffered during the transfer is sent next, like any
+		// stream the replica has yet to catch up with.
+		r.state = replicaOnline
+		r.lastAck = time.Now()
+	}
+	for err == nil {
+		for len(r.buf) == 0 && !r.closed {
+			r.wake.Wait()
+		}
+		if r.closed {
+			return
+		}
+		buf := r.buf
+		r.buf = nil
+		config.ReplicaMu.Unlock()
+		_, err = r.conn.Write(buf)
+		config.ReplicaMu.Lock()
+	}
+	if !r.closed {
+		fmt.Printf("Error sending to replica %s: %v\n", addr, err)
+		dropReplica(addr, r, config)
+	}
 }
 
 func buildRespArray(parts []string) string {
@@ -275,35 +897,12 @@ func buildRespArray(parts []string) string {
 	return sb.String()
 }
 
+// propagateToReplicas sends a write to the replicas through the
+// replication stream.
 func propagateToReplicas(parts []string, config *Config) {
-	partsCopy := append([]string(nil), parts...)
-	payload := buildRespArray(partsCopy)
-
-	// bump the master's replication offset by the exact bytes we sent
-	size := len(payload)
-	config.ReplicaMu.Lock()
-	config.ReplOffset += int64(size)
-	config.ReplicaMu.Unlock()
-
-	// now send to each live replica
+	payload := buildRespArray(parts)
 	config.ReplicaMu.Lock()
-	var activeConns []net.Conn
-	for _, conn := range config.replicaConns {
-		activeConns = append(activeConns, conn)
-	}
+	sent := feedReplicationStream([]byte(payload), config)
 	config.ReplicaMu.Unlock()
-
-	success := 0
-	for _, conn := range activeConns {
-		if _, err := conn.Write([]byte(payload)); err != nil {
-			addr := conn.RemoteAddr().String()
-			fmt.Printf("Error sending command to replica %s: %v\n", addr, err)
-			config.ReplicaMu.Lock()
-			delete(config.replicaConns, addr)
-			config.ReplicaMu.Unlock()
-			continue
-		}
-		success++
-	}
-	fmt.Printf("Propagated command to %d live replica connections\n", success)
+	fmt.Printf("Propagated command to %d live replica connections\n", sent)
 }
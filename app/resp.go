@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Request limits, matching the defaults of a stock redis.conf.
+const (
+	defaultProtoMaxBulkLen = 512 * 1024 * 1024
+	maxMultibulkLen        = 1024 * 1024
+	maxInlineLen           = 64 * 1024
+)
+
+// protocolError is returned for malformed requests. The connection that
+// produced it is answered with the message and then closed.
+type protocolError struct {
+	msg string
+}
+
+func (e *protocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+// readRequest reads a single request, either a RESP multibulk array or an
+// inline command as typed into telnet. Every bulk string is read using its
+// declared length, so arguments may contain CR, LF, spaces or any other byte.
+// It returns the arguments and the number of bytes consumed from the reader.
+// A maxBulkLen of zero disables the bulk length limit.
+func readRequest(reader *bufio.Reader, maxBulkLen int64) ([]string, int, error) {
+	total := 0
+	line, err := readLine(reader, maxInlineLen)
+	total += len(line)
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, total, &protocolError{"too big inline request"}
+		}
+		return nil, total, err
+	}
+	header := trimCRLF(line)
+	if len(header) == 0 || header[0] != '*' {
+		parts, err := splitArgs(string(header))
+		if err != nil {
+			return nil, total, &protocolError{"unbalanced quotes in request"}
+		}
+		return parts, total, nil
+	}
+	numElems, err := strconv.ParseInt(string(header[1:]), 10, 64)
+	if err != nil || numElems > maxMultibulkLen {
+		return nil, total, &protocolError{"invalid multibulk length"}
+	}
+	if numElems <= 0 {
+		return nil, total, nil
+	}
+
+	// The header alone is no proof the arguments follow, so don't trust it
+	// for more than a small preallocation.
+	parts := make([]string, 0, min(numElems, 1024))
+	for i := int64(0); i < numElems; i++ {
+		line, err := readLine(reader, maxInlineLen)
+		total += len(line)
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				return nil, total, &protocolError{"too big bulk count string"}
+			}
+			return nil, total, err
+		}
+		bulkHeader := trimCRLF(line)
+		if len(bulkHeader) == 0 || bulkHeader[0] != '$' {
+			return nil, total, &protocolError{fmt.Sprintf("expected '$', got '%s'", firstByte(bulkHeader))}
+		}
+		strLen, err := strconv.ParseInt(string(bulkHeader[1:]), 10, 64)
+		if err != nil || strLen < 0 || (maxBulkLen > 0 && strLen > maxBulkLen) {
+			return nil, total, &protocolError{"invalid bulk length"}
+		}
+		// +2 for the trailing \r\n
+		buf, n, err := readBulk(reader, strLen+2)
+		total += n
+		if err != nil {
+			return nil, total, err
+		}
+		parts = append(parts, string(buf[:strLen]))
+	}
+	return parts, total, nil
+}
+
+// readBulk reads exactly n bytes. Big bulks are read into a buffer that
+// grows with the data actually received, so a declared length alone can't
+// make us allocate up to proto-max-bulk-len.
+func readBulk(reader *bufio.Reader, n int64) ([]byte, int, error) {
+	if n <= 64*1024 {
+		buf := make([]byte, n)
+		read, err := io.ReadFull(reader, buf)
+		return buf, read, err
+	}
+	var buf bytes.Buffer
+	read, err := io.CopyN(&buf, reader, n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), int(read), err
+}
+
+// readLine reads up to and including the next '\n'. It fails with
+// bufio.ErrBufferFull once more than limit bytes are read without one.
+func readLine(reader *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			return line, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+		if len(line) > limit {
+			return line, bufio.ErrBufferFull
+		}
+	}
+}
+
+func trimCRLF(line []byte) []byte {
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+func firstByte(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return string(b[:1])
+}
+
+// splitArgs splits an inline command line into arguments. Arguments are
+// separated by whitespace and may be double quoted, with C-style escapes
+// such as \n and \x41, or single quoted, where only \' is special.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+		var arg []byte
+		inDouble, inSingle := false, false
+		for done := false; !done; {
+			if inDouble {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced quotes")
+				}
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					arg = append(arg, hexDigitValue(line[i+2])<<4|hexDigitValue(line[i+3]))
+					i += 3
+				} else if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				} else if line[i] == '"' {
+					// The closing quote must be followed by a space or the end.
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes")
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
+			} else if inSingle {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced quotes")
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if line[i] == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes")
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
+			} else {
+				if i >= len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func encodeArray(arr []string) []byte {
+	result := "*" + strconv.Itoa(len(arr)) + "\r\n"
+	for _, s := range arr {
+		result += "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+	}
+	return []byte(result)
+}
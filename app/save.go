@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// bgsaveRetryDelay is how long after a failed BGSAVE save points may
+// trigger another one, so a full disk is not hammered every tick.
+const bgsaveRetryDelay = 5 * time.Second
+
+// saveParam is a save point: snapshot once at least changes writes
+// happened and seconds passed since the last successful save.
+type saveParam struct {
+	seconds int
+	changes int64
+}
+
+var defaultSaveParams = []saveParam{{3600, 1}, {300, 100}, {60, 10000}}
+
+// saveCron checks the save points hz times per second.
+func saveCron(config *Config) {
+	for {
+		db.mu.Lock()
+		hz := config.Hz
+		checkSavePoints(config)
+		db.mu.Unlock()
+		time.Sleep(time.Second / time.Duration(hz))
+	}
+}
+
+// checkSavePoints starts a BGSAVE if one was scheduled or any save point
+// is reached. After a failed BGSAVE it waits bgsaveRetryDelay before trying
+// again. The keyspace must be locked.
+func checkSavePoints(config *Config) {
+	if rdbSave.bgsaveInProgress {
+		return
+	}
+	now := time.Now()
+	canRetry := rdbSave.lastBgsaveOK || now.Sub(rdbSave.lastBgsaveTry) > bgsaveRetryDelay
+	if rdbSave.bgsaveScheduled && canRetry {
+		startBGSave(config)
+		return
+	}
+	changes := db.dirty - rdbSave.dirtyAtLastSave
+	for _, sp := range config.SaveParams {
+		if changes >= sp.changes &&
+			now.Sub(rdbSave.lastSave) > time.Duration(sp.seconds)*time.Second && canRetry {
+			fmt.Printf("%d changes in %d seconds. Saving...\n", sp.changes, sp.seconds)
+			startBGSave(config)
+			return
+		}
+	}
+}
+
+// rejectWriteOnDiskError replies with MISCONF and returns true if cmd is a
+// write and the data cannot currently be persisted: the last background
+// save failed while save points are configured and
+// stop-writes-on-bgsave-error is on, or the last AOF write failed.
+// Accepting writes that will never reach the disk would hide the failure
+// until a restart loses them.
+func rejectWriteOnDiskError(conn net.Conn, cmd *redisCommand, config *Config) bool {
+	if cmd.flags&cmdWrite == 0 {
+		return false
+	}
+	db.mu.Lock()
+	rdbDenied := config.StopWritesOnBgsaveError && len(config.SaveParams) > 0 && !rdbSave.lastBgsaveOK
+	aofErr := aofLog.lastWriteErr
+	db.mu.Unlock()
+	switch {
+	case rdbDenied:
+		conn.Write([]byte("-MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk. " +
+			"Commands that may modify the data set are disabled, because this instance is configured to report errors " +
+			"during writes if RDB snapshotting fails (stop-writes-on-bgsave-error option). " +
+			"Please check the Redis logs for details about the RDB error.\r\n"))
+	case aofErr != nil:
+		fmt.Fprintf(conn, "-MISCONF Errors writing to the AOF file: %v\r\n", aofErr)
+	default:
+		return false
+	}
+	return true
+}
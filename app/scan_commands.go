@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// scanOptions holds the arguments following the cursor of SCAN, HSCAN,
+// SSCAN and ZSCAN.
+type scanOptions struct {
+	cursor  uint64
+	count   int
+	pattern string // "" matches everything
+	typ     string // SCAN only; "" means any type
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT count] [TYPE type]"
+// from args, replying with an error and returning false if they are
+// invalid. TYPE is only accepted when allowType is set.
+func parseScanArgs(conn net.Conn, args []string, allowType bool) (scanOptions, bool) {
+	opts := scanOptions{count: 10}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		conn.Write([]byte("-ERR invalid cursor\r\n"))
+		return opts, false
+	}
+	opts.cursor = cursor
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			conn.Write([]byte("-ERR syntax error\r\n"))
+			return opts, false
+		}
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				conn.Write([]byte("-ERR value is not an integer or out of range\r\n"))
+				return opts, false
+			}
+			if n < 1 {
+				conn.Write([]byte("-ERR syntax error\r\n"))
+				return opts, false
+			}
+			opts.count = n
+		case "MATCH":
+			opts.pattern = args[i+1]
+			if opts.pattern == "*" {
+				opts.pattern = ""
+			}
+		case "TYPE":
+			if !allowType {
+				conn.Write([]byte("-ERR syntax error\r\n"))
+				return opts, false
+			}
+			if _, ok := typeByName(args[i+1]); !ok {
+				fmt.Fprintf(conn, "-ERR unknown type name '%s'\r\n", args[i+1])
+				return opts, false
+			}
+			opts.typ = strings.ToLower(args[i+1])
+		default:
+			conn.Write([]byte("-ERR syntax error\r\n"))
+			return opts, false
+		}
+	}
+	return opts, true
+}
+
+func typeByName(name string) (valueType, bool) {
+	for t := typeString; t <= typeStream; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// scanDict visits buckets of d from opts.cursor until it has collected
+// opts.count entries or visited ten times that many buckets, and returns
+// the next cursor. Like Redis, COUNT is a hint: a bucket is never split
+// across calls, so a call may return more entries.
+func scanDict[V any](d *dict[V], opts scanOptions, fn func(key string, val V)) uint64 {
+	cursor := opts.cursor
+	found := 0
+	// Clamped so a huge COUNT can't overflow: the scan ends with the dict
+	// long before.
+	for iterations := min(opts.count, math.MaxInt/10) * 10; iterations > 0; iterations-- {
+		cursor = d.scan(cursor, func(key string, val V) {
+			found++
+			fn(key, val)
+		})
+		if cursor == 0 || found >= opts.count {
+			break
+		}
+	}
+	return cursor
+}
+
+func writeScanReply(conn net.Conn, cursor uint64, items []string) {
+	c := strconv.FormatUint(cursor, 10)
+	fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n", len(c), c)
+	conn.Write(encodeArray(items))
+}
+
+// handleScan iterates the keyspace. Every key present from the first call
+// to the one returning cursor 0 is returned at least once, however the
+// keyspace grows or shrinks in between; MATCH and TYPE filter what each
+// call found, so a call may return no keys yet a non-zero cursor.
+func handleScan(conn net.Conn, parts []string, config *Config) {
+	opts, ok := parseScanArgs(conn, parts[1:], true)
+	if !ok {
+		return
+	}
+	var candidates []string
+	cursor := scanDict(db.dict, opts, func(key string, _ *redisObject) {
+		if opts.pattern == "" || stringMatch(opts.pattern, key, false) {
+			candidates = append(candidates, key)
+		}
+	})
+	// Expiry is checked after the walk, as deleting an expired key may
+	// shrink the table.
+	keys := []string{}
+	for _, key := range candidates {
+		obj := db.lookup(key)
+		if obj == nil || (opts.typ != "" && obj.typ.String() != opts.typ) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	writeScanReply(conn, cursor, keys)
+}
+
+// scanValue looks up the key of an HSCAN, SSCAN or ZSCAN. A missing key is
+// an empty, completed iteration.
+func scanValue(conn net.Conn, parts []string, t valueType) (*redisObject, scanOptions, bool) {
+	obj := db.lookup(parts[1])
+	if !checkType(conn, obj, t) {
+		return nil, scanOptions{}, false
+	}
+	opts, ok := parseScanArgs(conn, parts[2:], false)
+	if !ok {
+		return nil, opts, false
+	}
+	if obj == nil {
+		writeScanReply(conn, 0, nil)
+		return nil, opts, false
+	}
+	return obj, opts, true
+}
+
+func handleHScan(conn net.Conn, parts []string, config *Config) {
+	obj, opts, ok := scanValue(conn, parts, typeHash)
+	if !ok {
+		return
+	}
+	items := []string{}
+	cursor := scanDict(obj.value.(*dict[string]), opts, func(field, value string) {
+		if opts.pattern == "" || stringMatch(opts.pattern, field, false) {
+			items = append(items, field, value)
+		}
+	})
+	writeScanReply(conn, cursor, items)
+}
+
+func handleSScan(conn net.Conn, parts []string, config *Config) {
+	obj, opts, ok := scanValue(conn, parts, typeSet)
+	if !ok {
+		return
+	}
+	items := []string{}
+	cursor := scanDict(obj.value.(*dict[struct{}]), opts, func(member string, _ struct{}) {
+		if opts.pattern == "" || stringMatch(opts.pattern, member, false) {
+			items = append(items, member)
+		}
+	})
+	writeScanReply(conn, cursor, items)
+}
+
+func handleZScan(conn net.Conn, parts []string, config *Config) {
+	obj, opts, ok := scanValue(conn, parts, typeZSet)
+	if !ok {
+		return
+	}
+	items := []string{}
+	cursor := scanDict(obj.value.(*dict[float64]), opts, func(member string, score float64) {
+		if opts.pattern == "" || stringMatch(opts.pattern, member, false) {
+			items = append(items, member, formatScore(score))
+		}
+	})
+	writeScanReply(conn, cursor, items)
+}
+
+// formatScore renders a sorted set score the way Redis replies with one:
+// the shortest representation that parses back to the same value.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/aof"
+)
+
+var (
+	errUnterminatedMulti = errors.New("unexpected end of file inside MULTI")
+	errNestedMulti       = errors.New("MULTI inside MULTI")
+	errExecWithoutMulti  = errors.New("EXEC without MULTI")
+)
+
+// checkManifest checks every file of a multi-part AOF in load order. Only
+// the last file may be fixed, as the server only tolerates a truncated
+// last file.
+func checkManifest(filename string, out *output) bool {
+	m, err := aof.LoadManifest(filename)
+	if err != nil {
+		logf("Cannot read the manifest %s: %v", filename, err)
+		return false
+	}
+	logf("Checking multi-part AOF manifest %s", filename)
+	dir := filepath.Dir(filename)
+	files := m.Files()
+	if len(files) == 0 {
+		logf("The manifest lists no files")
+		return true
+	}
+	for i, f := range files {
+		name := filepath.Join(dir, f.Name)
+		last := i == len(files)-1
+		var ok bool
+		if f.Type == aof.TypeBase && isRDB(name) {
+			ok = checkRDBFile(name, out)
+		} else {
+			ok = checkAOFFile(name, last, out)
+		}
+		if !ok {
+			return false
+		}
+	}
+	logf("All AOF files and manifest are valid")
+	return true
+}
+
+// checkAOFFile validates an append only file, feeding its RDB preamble and
+// commands to out. A damaged file is truncated to its last valid command
+// with -fix, when fixable is set.
+func checkAOFFile(filename string, fixable bool, out *output) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		logf("Cannot open %s: %v", filename, err)
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		logf("Cannot stat %s: %v", filename, err)
+		return false
+	}
+	logf("Checking AOF file %s", filename)
+
+	r := aof.NewReader(f)
+	if r.HasPreamble() {
+		logf("The AOF appears to start with an RDB preamble.")
+		if !checkRDB(r.RDB(), out) {
+			logf("RDB preamble of AOF file is not sane, aborting.")
+			return false
+		}
+	}
+	valid, cause := scanAOF(filename, r, out)
+	if cause == nil {
+		logf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=0", filename, fi.Size(), valid)
+		logf("AOF %s is valid", filename)
+		return true
+	}
+
+	logf("0x%x: %v", valid, cause)
+	logf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d", filename, fi.Size(), valid, fi.Size()-valid)
+	if !*fix {
+		logf("AOF %s is not valid. Use the -fix option to try fixing it.", filename)
+		return false
+	}
+	if !fixable {
+		logf("AOF %s is not the last file of the AOF and cannot be fixed.", filename)
+		return false
+	}
+	if !confirm(fmt.Sprintf("This will shrink the AOF %s from %d bytes, with %d bytes, to %d bytes.",
+		filename, fi.Size(), fi.Size()-valid, valid)) {
+		logf("Aborted.")
+		return false
+	}
+	if err := os.Truncate(filename, valid); err != nil {
+		logf("Failed to truncate AOF %s: %v", filename, err)
+		return false
+	}
+	logf("Successfully truncated AOF %s", filename)
+	return true
+}
+
+// scanAOF reads the commands of an AOF up to its end or the first damage,
+// and returns the offset up to which it is valid and what is wrong past
+// it, nil if nothing is. A MULTI without its EXEC is invalid from the
+// MULTI on, as the server would not apply it.
+func scanAOF(filename string, r *aof.Reader, out *output) (int64, error) {
+	inMulti := false
+	var multiStart int64
+	for {
+		args, err := r.Next()
+		if err == io.EOF {
+			if inMulti {
+				return multiStart, errUnterminatedMulti
+			}
+			return r.Offset(), nil
+		}
+		if err != nil {
+			if inMulti {
+				return multiStart, err
+			}
+			return r.Offset(), err
+		}
+		switch strings.ToLower(args[0]) {
+		case "multi":
+			if inMulti {
+				return multiStart, errNestedMulti
+			}
+			inMulti = true
+			multiStart = r.Start()
+		case "exec":
+			if !inMulti {
+				return r.Start(), errExecWithoutMulti
+			}
+			inMulti = false
+		}
+		out.command(filename, r.Start(), args)
+	}
+}
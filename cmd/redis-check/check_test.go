@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/aof"
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+const (
+	setCmd   = "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	multiCmd = "*1\r\n$5\r\nMULTI\r\n"
+	execCmd  = "*1\r\n$4\r\nEXEC\r\n"
+)
+
+// errAny stands for any error reporting a damaged file.
+var errAny = errors.New("any error")
+
+// rdbFile returns an RDB file holding a few string keys.
+func rdbFile(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := rdb.NewEncoder(&buf)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteSelectDB(0, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := enc.WriteEntry(&rdb.Entry{Key: k, Kind: rdb.KindString, Value: "value of " + k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.WriteEOF(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckRDB(t *testing.T) {
+	good := rdbFile(t)
+	corrupt := bytes.Clone(good)
+	corrupt[bytes.Index(corrupt, []byte("value of b"))] ^= 1
+	badSum := bytes.Clone(good)
+	badSum[len(badSum)-1] ^= 0xff
+	noSum := bytes.Clone(good)
+	copy(noSum[len(noSum)-8:], make([]byte, 8))
+	tests := []struct {
+		name string
+		file []byte
+		ok   bool
+	}{
+		{"valid", good, true},
+		{"checksum disabled", noSum, true},
+		{"corrupt value", corrupt, false},
+		{"corrupt checksum", badSum, false},
+		{"truncated checksum", good[:len(good)-4], false},
+		{"truncated entry", good[:len(good)-15], false},
+		{"not an RDB file", []byte("REDIS-garbage"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := newReportOutput(5)
+			if ok := checkRDB(bytes.NewReader(tt.file), out); ok != tt.ok {
+				t.Fatalf("checkRDB = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestScanAOF(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		valid int
+		err   error // nil for a valid file, errAny for any other error
+	}{
+		{"empty", "", 0, nil},
+		{"valid", setCmd + setCmd, 2 * len(setCmd), nil},
+		{"transaction", setCmd + multiCmd + setCmd + execCmd, len(setCmd + multiCmd + setCmd + execCmd), nil},
+		{"truncated command", setCmd + setCmd[:10], len(setCmd), aof.ErrTruncated},
+		{"truncated final CRLF", setCmd + setCmd[:len(setCmd)-1], len(setCmd), aof.ErrTruncated},
+		{"truncated inside MULTI", setCmd + multiCmd + setCmd + execCmd[:5], len(setCmd), aof.ErrTruncated},
+		{"MULTI without EXEC", setCmd + multiCmd + setCmd, len(setCmd), errUnterminatedMulti},
+		{"nested MULTI", multiCmd + setCmd + multiCmd, 0, errNestedMulti},
+		{"EXEC without MULTI", setCmd + execCmd, len(setCmd), errExecWithoutMulti},
+		{"garbage tail", setCmd + "garbage\r\n", len(setCmd), errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := aof.NewReader(strings.NewReader(tt.file))
+			valid, err := scanAOF("test.aof", r, newReportOutput(5))
+			if valid != int64(tt.valid) {
+				t.Errorf("valid up to %d, want %d", valid, tt.valid)
+			}
+			switch {
+			case tt.err == nil && err != nil, tt.err != nil && err == nil:
+				t.Errorf("error %v, want %v", err, tt.err)
+			case tt.err != nil && tt.err != errAny && !errors.Is(err, tt.err):
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		files    map[string]string
+		ok       bool
+	}{
+		{"valid", "file a.1.base.rdb seq 1 type b\nfile a.1.incr.aof seq 1 type i\n",
+			map[string]string{"a.1.base.rdb": "rdb", "a.1.incr.aof": setCmd}, true},
+		{"no files", "# nothing yet\n", nil, true},
+		{"truncated last file", "file a.1.base.rdb seq 1 type b\nfile a.1.incr.aof seq 1 type i\n",
+			map[string]string{"a.1.base.rdb": "rdb", "a.1.incr.aof": setCmd + setCmd[:7]}, false},
+		{"truncated file before the last", "file a.1.incr.aof seq 1 type i\nfile a.2.incr.aof seq 2 type i\n",
+			map[string]string{"a.1.incr.aof": setCmd[:7], "a.2.incr.aof": setCmd}, false},
+		{"corrupt base", "file a.1.base.rdb seq 1 type b\n",
+			map[string]string{"a.1.base.rdb": "corrupt rdb"}, false},
+		{"missing file", "file a.1.incr.aof seq 1 type i\n", nil, false},
+		{"malformed line", "file a.1.incr.aof seq 1 type i\nfile a.2.incr.aof seq x type i\n",
+			map[string]string{"a.1.incr.aof": setCmd}, false},
+		{"odd number of fields", "file a.1.incr.aof seq 1 type\n",
+			map[string]string{"a.1.incr.aof": setCmd}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			write := func(name string, data []byte) {
+				if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, content := range tt.files {
+				data := []byte(content)
+				switch content {
+				case "rdb":
+					data = rdbFile(t)
+				case "corrupt rdb":
+					data = rdbFile(t)
+					data[len(data)-1] ^= 0xff
+				}
+				write(name, data)
+			}
+			write("a.manifest", []byte(tt.manifest))
+			if ok := checkManifest(filepath.Join(dir, "a.manifest"), newReportOutput(5)); ok != tt.ok {
+				t.Fatalf("checkManifest = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
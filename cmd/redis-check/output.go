@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+// ttlBuckets are the upper bounds of the expiry histogram; a last bucket
+// holds the longer TTLs.
+var ttlBuckets = []struct {
+	label string
+	limit time.Duration
+}{
+	{"< 1m", time.Minute},
+	{"< 1h", time.Hour},
+	{"< 1d", 24 * time.Hour},
+	{"< 1w", 7 * 24 * time.Hour},
+	{"< 30d", 30 * 24 * time.Hour},
+}
+
+type bigKey struct {
+	key  string
+	size int
+}
+
+// output receives the keys and commands read from the files. In dump mode
+// it writes each as a JSON line; otherwise it gathers the statistics that
+// finish reports.
+type output struct {
+	enc *json.Encoder
+	top int
+	now time.Time
+
+	keys map[rdb.Kind]int
+	// biggest holds the top largest keys of each kind, largest first.
+	biggest map[rdb.Kind][]bigKey
+	// ttls counts the keys with a TTL by bucket: already expired, then one
+	// per ttlBuckets entry, then longer.
+	ttls       []int
+	persistent int
+	commands   map[string]int
+}
+
+func newDumpOutput(w io.Writer) *output {
+	return &output{enc: json.NewEncoder(w)}
+}
+
+func newReportOutput(top int) *output {
+	return &output{
+		top:      top,
+		now:      time.Now(),
+		keys:     make(map[rdb.Kind]int),
+		biggest:  make(map[rdb.Kind][]bigKey),
+		ttls:     make([]int, len(ttlBuckets)+2),
+		commands: make(map[string]int),
+	}
+}
+
+func (o *output) entry(e *rdb.Entry) {
+	if o.enc != nil {
+		o.enc.Encode(entryJSON(e))
+		return
+	}
+	o.keys[e.Kind]++
+	o.addBiggest(e.Kind, bigKey{e.Key, e.Len()})
+	if e.ExpireAt == 0 {
+		o.persistent++
+		return
+	}
+	ttl := time.UnixMilli(e.ExpireAt).Sub(o.now)
+	bucket := 0
+	if ttl > 0 {
+		bucket = 1
+		for bucket <= len(ttlBuckets) && ttl >= ttlBuckets[bucket-1].limit {
+			bucket++
+		}
+	}
+	o.ttls[bucket]++
+}
+
+func (o *output) addBiggest(kind rdb.Kind, k bigKey) {
+	list := o.biggest[kind]
+	if len(list) == o.top && (o.top == 0 || list[len(list)-1].size >= k.size) {
+		return
+	}
+	i := sort.Search(len(list), func(i int) bool { return list[i].size < k.size })
+	list = append(list, bigKey{})
+	copy(list[i+1:], list[i:])
+	list[i] = k
+	if len(list) > o.top {
+		list = list[:o.top]
+	}
+	o.biggest[kind] = list
+}
+
+func (o *output) command(file string, offset int64, args []string) {
+	if o.enc != nil {
+		o.enc.Encode(struct {
+			File   string   `json:"file"`
+			Offset int64    `json:"offset"`
+			Args   []string `json:"args"`
+		}{file, offset, args})
+		return
+	}
+	o.commands[strings.ToUpper(args[0])]++
+}
+
+// finish prints the report gathered from every file.
+func (o *output) finish() {
+	if o.enc != nil {
+		return
+	}
+	total := 0
+	for _, n := range o.keys {
+		total += n
+	}
+	if total > 0 {
+		fmt.Printf("\n# Keys: %d (%d with a TTL)\n", total, total-o.persistent)
+		for k := rdb.KindString; k <= rdb.KindStream; k++ {
+			if o.keys[k] > 0 {
+				fmt.Printf("%-8s %d\n", k, o.keys[k])
+			}
+		}
+		fmt.Println("\n# Biggest keys")
+		for k := rdb.KindString; k <= rdb.KindStream; k++ {
+			unit := "items"
+			if k == rdb.KindString {
+				unit = "bytes"
+			}
+			for _, b := range o.biggest[k] {
+				fmt.Printf("%-8s %q %d %s\n", k, b.key, b.size, unit)
+			}
+		}
+		if o.persistent < total {
+			fmt.Println("\n# Expiry histogram")
+			fmt.Printf("%-8s %d\n", "expired", o.ttls[0])
+			for i, b := range ttlBuckets {
+				fmt.Printf("%-8s %d\n", b.label, o.ttls[i+1])
+			}
+			fmt.Printf("%-8s %d\n", ">= 30d", o.ttls[len(ttlBuckets)+1])
+		}
+	}
+	if len(o.commands) > 0 {
+		names := make([]string, 0, len(o.commands))
+		n := 0
+		for name, count := range o.commands {
+			names = append(names, name)
+			n += count
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if o.commands[names[i]] != o.commands[names[j]] {
+				return o.commands[names[i]] > o.commands[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		fmt.Printf("\n# Commands: %d\n", n)
+		for _, name := range names {
+			fmt.Printf("%-12s %d\n", name, o.commands[name])
+		}
+	}
+}
+
+// entryJSON is the JSON form of a key. Scores that JSON cannot represent,
+// the infinities, are written as the strings "inf" and "-inf".
+func entryJSON(e *rdb.Entry) interface{} {
+	var value interface{}
+	switch v := e.Value.(type) {
+	case []rdb.ZMember:
+		members := make([]interface{}, len(v))
+		for i, m := range v {
+			var score interface{} = m.Score
+			if math.IsInf(m.Score, 1) {
+				score = "inf"
+			} else if math.IsInf(m.Score, -1) {
+				score = "-inf"
+			}
+			members[i] = map[string]interface{}{"member": m.Member, "score": score}
+		}
+		value = members
+	case *rdb.Stream:
+		entries := make([]interface{}, len(v.Entries))
+		for i, se := range v.Entries {
+			entries[i] = map[string]interface{}{"id": se.ID.String(), "fields": se.Fields}
+		}
+		value = map[string]interface{}{"last_id": v.LastID.String(), "entries": entries}
+	default:
+		value = v
+	}
+	line := map[string]interface{}{
+		"db":    e.DB,
+		"key":   e.Key,
+		"type":  e.Kind.String(),
+		"value": value,
+	}
+	if e.ExpireAt != 0 {
+		line["expire_at_ms"] = e.ExpireAt
+	}
+	return line
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+// checkRDBFile validates an RDB file and feeds its keys to out.
+func checkRDBFile(filename string, out *output) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		logf("Cannot open %s: %v", filename, err)
+		return false
+	}
+	defer f.Close()
+	logf("Checking RDB file %s", filename)
+	if !checkRDB(f, out) {
+		logf("RDB file %s is not valid", filename)
+		return false
+	}
+	logf("RDB looks OK!")
+	return true
+}
+
+// checkRDB decodes an RDB stream, which may be the preamble of an AOF, and
+// feeds its keys to out.
+func checkRDB(r io.Reader, out *output) bool {
+	dec := rdb.NewDecoder(r)
+	keys := 0
+	err := dec.Decode(func(e *rdb.Entry) error {
+		keys++
+		out.entry(e)
+		return nil
+	})
+	if dec.Version > 0 {
+		logf("RDB version %d", dec.Version)
+	}
+	for _, k := range []string{"redis-ver", "redis-bits", "ctime", "used-mem", "aof-base"} {
+		if v, ok := dec.Aux[k]; ok {
+			logf("AUX %s = '%s'", k, v)
+		}
+	}
+	if err != nil {
+		logf("--- RDB ERROR DETECTED ---")
+		logf("Error after %d keys: %v", keys, err)
+		return false
+	}
+	if dec.Checksum == 0 {
+		logf("RDB file was saved with checksum disabled: no check performed.")
+	} else {
+		logf("Checksum OK")
+	}
+	logf("Checked %d keys", keys)
+	return true
+}
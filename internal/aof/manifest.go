@@ -0,0 +1,175 @@
+// Package aof reads Redis append only files and the manifest that ties
+// the files of a multi-part AOF together.
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FileType is the role of a file in the manifest.
+type FileType byte
+
+const (
+	// TypeBase is the file a rewrite produced: an RDB snapshot, or
+	// commands rebuilding the dataset.
+	TypeBase FileType = 'b'
+	// TypeIncr files hold the commands logged since the base, in order.
+	TypeIncr FileType = 'i'
+	// TypeHistory files were replaced by a rewrite and are about to be
+	// deleted; they are never loaded.
+	TypeHistory FileType = 'h'
+)
+
+// File is a manifest entry. Names are relative to the AOF directory.
+type File struct {
+	Name string
+	Seq  int64
+	Type FileType
+}
+
+// Manifest lists the files of a multi-part AOF. Loading the base and then
+// the incremental files in order rebuilds the dataset.
+type Manifest struct {
+	Base    *File // nil before the first rewrite
+	Incrs   []*File
+	History []*File
+	// BaseSeq and IncrSeq are the highest sequence numbers used so far;
+	// new files take the next ones.
+	BaseSeq int64
+	IncrSeq int64
+}
+
+// ManifestName returns the manifest file name for appendfilename name.
+func ManifestName(name string) string {
+	return name + ".manifest"
+}
+
+// BaseName returns the name of base file seq, with the extension telling
+// whether it is an RDB snapshot.
+func BaseName(name string, seq int64, rdb bool) string {
+	ext := "aof"
+	if rdb {
+		ext = "rdb"
+	}
+	return fmt.Sprintf("%s.%d.base.%s", name, seq, ext)
+}
+
+// IncrName returns the name of incremental file seq.
+func IncrName(name string, seq int64) string {
+	return fmt.Sprintf("%s.%d.incr.aof", name, seq)
+}
+
+// ReadManifest parses a manifest: one "file <name> seq <n> type <t>" line
+// per file, in any key order, with # starting a comment.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		f, err := parseManifestLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("aof: invalid manifest line %d: %v", n, err)
+		}
+		switch f.Type {
+		case TypeBase:
+			if m.Base != nil {
+				return nil, fmt.Errorf("aof: invalid manifest line %d: more than one base file", n)
+			}
+			m.Base = f
+			m.BaseSeq = f.Seq
+		case TypeIncr:
+			if f.Seq <= m.IncrSeq {
+				return nil, fmt.Errorf("aof: invalid manifest line %d: incr files out of order", n)
+			}
+			m.Incrs = append(m.Incrs, f)
+			m.IncrSeq = f.Seq
+		case TypeHistory:
+			m.History = append(m.History, f)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseManifestLine(line string) (*File, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("odd number of fields")
+	}
+	f := &File{}
+	for i := 0; i < len(fields); i += 2 {
+		v := fields[i+1]
+		switch fields[i] {
+		case "file":
+			if strings.ContainsRune(v, '/') {
+				return nil, fmt.Errorf("file name %q is a path", v)
+			}
+			f.Name = v
+		case "seq":
+			seq, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || seq < 1 {
+				return nil, fmt.Errorf("bad seq %q", v)
+			}
+			f.Seq = seq
+		case "type":
+			if len(v) != 1 || (v[0] != byte(TypeBase) && v[0] != byte(TypeIncr) && v[0] != byte(TypeHistory)) {
+				return nil, fmt.Errorf("bad type %q", v)
+			}
+			f.Type = FileType(v[0])
+		}
+		// Unknown keys are skipped, so newer manifests stay readable.
+	}
+	if f.Name == "" || f.Seq == 0 || f.Type == 0 {
+		return nil, errors.New("missing file, seq or type")
+	}
+	return f, nil
+}
+
+// LoadManifest reads the manifest file at filename.
+func LoadManifest(filename string) (*Manifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadManifest(f)
+}
+
+// Bytes encodes the manifest: the base, the history files and the
+// incremental files in load order.
+func (m *Manifest) Bytes() []byte {
+	var sb strings.Builder
+	write := func(f *File) {
+		fmt.Fprintf(&sb, "file %s seq %d type %c\n", f.Name, f.Seq, f.Type)
+	}
+	if m.Base != nil {
+		write(m.Base)
+	}
+	for _, f := range m.History {
+		write(f)
+	}
+	for _, f := range m.Incrs {
+		write(f)
+	}
+	return []byte(sb.String())
+}
+
+// Files returns the files to load, in order.
+func (m *Manifest) Files() []*File {
+	var files []*File
+	if m.Base != nil {
+		files = append(files, m.Base)
+	}
+	return append(files, m.Incrs...)
+}
@@ -0,0 +1,74 @@
+package aof
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	m, err := ReadManifest(strings.NewReader(
+		"# written by hand\n" +
+			"file appendonly.aof.2.base.rdb seq 2 type b\n" +
+			"\n" +
+			"type h seq 1 file appendonly.aof.1.base.aof\n" +
+			"file appendonly.aof.3.incr.aof seq 3 type i startoffset 0\n" +
+			"  file appendonly.aof.4.incr.aof seq 4 type i  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Manifest{
+		Base:    &File{"appendonly.aof.2.base.rdb", 2, TypeBase},
+		Incrs:   []*File{{"appendonly.aof.3.incr.aof", 3, TypeIncr}, {"appendonly.aof.4.incr.aof", 4, TypeIncr}},
+		History: []*File{{"appendonly.aof.1.base.aof", 1, TypeHistory}},
+		BaseSeq: 2,
+		IncrSeq: 4,
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got %+v, want %+v", m, want)
+	}
+	if files := m.Files(); !reflect.DeepEqual(files, append([]*File{want.Base}, want.Incrs...)) {
+		t.Fatalf("files to load %+v", files)
+	}
+
+	again, err := ReadManifest(strings.NewReader(string(m.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, want) {
+		t.Fatalf("after a round trip got %+v, want %+v", again, want)
+	}
+}
+
+func TestReadManifestInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		err      string
+	}{
+		{"odd number of fields", "file a.aof seq 1 type\n", "line 1: odd number of fields"},
+		{"missing type", "file a.aof seq 1\n", "line 1: missing file, seq or type"},
+		{"missing file", "seq 1 type i\n", "line 1: missing file, seq or type"},
+		{"missing seq", "file a.aof type i\n", "line 1: missing file, seq or type"},
+		{"seq not a number", "file a.aof seq one type i\n", `line 1: bad seq "one"`},
+		{"seq zero", "file a.aof seq 0 type i\n", `line 1: bad seq "0"`},
+		{"negative seq", "file a.aof seq -3 type i\n", `line 1: bad seq "-3"`},
+		{"unknown type", "file a.aof seq 1 type x\n", `line 1: bad type "x"`},
+		{"long type", "file a.aof seq 1 type incr\n", `line 1: bad type "incr"`},
+		{"path as file name", "file ../a.aof seq 1 type i\n", `line 1: file name "../a.aof" is a path`},
+		{"two bases", "file a.rdb seq 1 type b\n# c\nfile b.rdb seq 2 type b\n", "line 3: more than one base file"},
+		{"incrs out of order", "file a.aof seq 2 type i\nfile b.aof seq 1 type i\n", "line 2: incr files out of order"},
+		{"repeated incr", "file a.aof seq 2 type i\nfile a.aof seq 2 type i\n", "line 2: incr files out of order"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadManifest(strings.NewReader(tt.manifest))
+			if err == nil {
+				t.Fatal("read without error")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %q, want it to mention %q", err, tt.err)
+			}
+		})
+	}
+}
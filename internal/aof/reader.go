@@ -0,0 +1,160 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrTruncated is returned by Next when the file ends in the middle of a
+// command, as left by a crash while it was written.
+var ErrTruncated = errors.New("aof: unexpected end of file")
+
+// maxArgs bounds the argument count of a command, like the server's
+// request limit, so a corrupt header is not mistaken for a huge command.
+const maxArgs = 1024 * 1024
+
+// Reader reads the commands of an append only file, which may start with
+// an RDB preamble.
+type Reader struct {
+	br *bufio.Reader
+	cr *countingReader
+	// start is where the command being read begins, offset where the
+	// last complete command ends.
+	start  int64
+	offset int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	cr := &countingReader{r: r}
+	return &Reader{br: bufio.NewReader(cr), cr: cr}
+}
+
+// HasPreamble reports whether the file starts with an RDB snapshot. The
+// snapshot is then read from RDB before calling Next.
+func (r *Reader) HasPreamble() bool {
+	b, _ := r.br.Peek(5)
+	return string(b) == "REDIS"
+}
+
+// RDB returns the underlying buffered reader, from which the RDB preamble
+// is decoded. An rdb.Decoder reading it stops right after the snapshot.
+func (r *Reader) RDB() *bufio.Reader {
+	return r.br
+}
+
+// Offset returns the file offset up to which the file is known to be
+// valid: the end of the last complete command or of the RDB preamble.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Start returns the file offset at which the command last returned by
+// Next begins.
+func (r *Reader) Start() int64 {
+	return r.start
+}
+
+func (r *Reader) pos() int64 {
+	return r.cr.n - int64(r.br.Buffered())
+}
+
+// Next reads the next command. It returns io.EOF at the end of the file,
+// ErrTruncated if the file ends within a command, and a descriptive error
+// if the file is not a valid AOF there.
+func (r *Reader) Next() ([]string, error) {
+	r.start = r.pos()
+	r.offset = r.start
+	if _, err := r.br.Peek(1); err != nil {
+		return nil, err
+	}
+	n, err := r.readHeader('*')
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || n > maxArgs {
+		return nil, fmt.Errorf("aof: bad argument count %d at offset %d", n, r.offset)
+	}
+	args := make([]string, 0, n)
+	for i := int64(0); i < n; i++ {
+		l, err := r.readHeader('$')
+		if err != nil {
+			return nil, err
+		}
+		if l < 0 {
+			return nil, fmt.Errorf("aof: bad bulk length %d at offset %d", l, r.offset)
+		}
+		// Copy rather than allocate l bytes up front, so a corrupt length
+		// fails at the end of the file instead of exhausting memory.
+		var sb strings.Builder
+		if _, err := io.CopyN(&sb, r.br, l); err != nil {
+			return nil, truncated(err)
+		}
+		if err := r.expectCRLF(); err != nil {
+			return nil, err
+		}
+		args = append(args, sb.String())
+	}
+	r.offset = r.pos()
+	return args, nil
+}
+
+// readHeader reads a "<prefix><number>\r\n" line.
+func (r *Reader) readHeader(prefix byte) (int64, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return 0, fmt.Errorf("aof: line too long at offset %d", r.offset)
+	}
+	if err != nil {
+		return 0, truncated(err)
+	}
+	if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("aof: expected '%c' at offset %d, got %q", prefix, r.offset, firstLine(line))
+	}
+	n, err := strconv.ParseInt(string(line[1:len(line)-2]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("aof: bad number %q at offset %d", line[1:len(line)-2], r.offset)
+	}
+	return n, nil
+}
+
+func (r *Reader) expectCRLF() error {
+	var b [2]byte
+	if _, err := io.ReadFull(r.br, b[:]); err != nil {
+		return truncated(err)
+	}
+	if b != [2]byte{'\r', '\n'} {
+		return fmt.Errorf("aof: missing CRLF after bulk string at offset %d", r.offset)
+	}
+	return nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+func firstLine(line []byte) string {
+	if len(line) > 32 {
+		line = line[:32]
+	}
+	return strings.TrimRight(string(line), "\r\n")
+}
+
+// countingReader counts the bytes read through it, so the reader knows
+// the file offset behind its buffer.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,97 @@
+package aof
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	setCmd = "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nhello\r\n"
+	delCmd = "*2\r\n$3\r\nDEL\r\n$1\r\nk\r\n"
+)
+
+// readAll reads commands until Next fails, and returns them with the
+// offset up to which the file was valid and the error.
+func readAll(s string) ([][]string, int64, error) {
+	r := NewReader(strings.NewReader(s))
+	var cmds [][]string
+	for {
+		args, err := r.Next()
+		if err != nil {
+			return cmds, r.Offset(), err
+		}
+		cmds = append(cmds, args)
+	}
+}
+
+func TestReader(t *testing.T) {
+	set := []string{"SET", "k", "hello"}
+	del := []string{"DEL", "k"}
+	tests := []struct {
+		name  string
+		in    string
+		want  [][]string
+		err   error // nil for a descriptive error other than these
+		valid int64
+	}{
+		{"empty", "", nil, io.EOF, 0},
+		{"complete", setCmd + delCmd, [][]string{set, del}, io.EOF, int64(len(setCmd + delCmd))},
+		{"binary value", "*1\r\n$4\r\na\r\nb\r\n", [][]string{{"a\r\nb"}}, io.EOF, 14},
+		{"truncated argument count", setCmd + "*3", [][]string{set}, ErrTruncated, int64(len(setCmd))},
+		{"truncated after argument count", setCmd + "*3\r\n", [][]string{set}, ErrTruncated, int64(len(setCmd))},
+		{"truncated bulk length", setCmd + "*2\r\n$3", [][]string{set}, ErrTruncated, int64(len(setCmd))},
+		{"truncated bulk string", setCmd + delCmd[:len(delCmd)-5], [][]string{set}, ErrTruncated, int64(len(setCmd))},
+		{"missing final CRLF", setCmd + delCmd[:len(delCmd)-2], [][]string{set}, ErrTruncated, int64(len(setCmd))},
+		{"half the final CRLF", setCmd + delCmd[:len(delCmd)-1], [][]string{set}, ErrTruncated, int64(len(setCmd))},
+		{"huge bulk length at the end", "*1\r\n$999999999999\r\nabc", nil, ErrTruncated, 0},
+		{"garbage after a command", setCmd + "hello\r\n", [][]string{set}, nil, int64(len(setCmd))},
+		{"bad argument count", "*0\r\n", nil, nil, 0},
+		{"too many arguments", "*99999999\r\n", nil, nil, 0},
+		{"negative bulk length", "*1\r\n$-1\r\n", nil, nil, 0},
+		{"bad number", "*1\r\n$x\r\n", nil, nil, 0},
+		{"no CR", "*1\n", nil, nil, 0},
+		{"no CRLF after bulk string", setCmd + "*1\r\n$1\r\nabc\r\n", [][]string{set}, nil, int64(len(setCmd))},
+		{"line too long", "*" + strings.Repeat("1", 8192) + "\r\n", nil, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds, valid, err := readAll(tt.in)
+			if !reflect.DeepEqual(cmds, tt.want) {
+				t.Errorf("commands %q, want %q", cmds, tt.want)
+			}
+			switch {
+			case tt.err != nil && !errors.Is(err, tt.err):
+				t.Errorf("error %v, want %v", err, tt.err)
+			case tt.err == nil && (errors.Is(err, io.EOF) || errors.Is(err, ErrTruncated)):
+				t.Errorf("error %v, want a corruption error", err)
+			}
+			if valid != tt.valid {
+				t.Errorf("valid up to %d, want %d", valid, tt.valid)
+			}
+		})
+	}
+}
+
+func TestReaderStart(t *testing.T) {
+	r := NewReader(strings.NewReader(setCmd + delCmd))
+	for _, want := range []int64{0, int64(len(setCmd))} {
+		if _, err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if r.Start() != want {
+			t.Fatalf("command starts at %d, want %d", r.Start(), want)
+		}
+	}
+}
+
+func TestReaderPreamble(t *testing.T) {
+	if NewReader(strings.NewReader(setCmd)).HasPreamble() {
+		t.Error("a plain AOF has a preamble")
+	}
+	if !NewReader(strings.NewReader("REDIS0011")).HasPreamble() {
+		t.Error("an RDB preamble was not detected")
+	}
+}
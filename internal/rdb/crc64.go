@@ -0,0 +1,30 @@
+package rdb
+
+// Redis checksums RDB files with the Jones CRC-64 variant: polynomial
+// 0xad93d23594c935a9 processed reflected, zero initial value and no final
+// xor, which is why hash/crc64 (which inverts the register) cannot be used.
+const jonesPoly = 0x95ac9329ac4bc9b5
+
+var crcTable = func() *[256]uint64 {
+	var t [256]uint64
+	for i := range t {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ jonesPoly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}()
+
+// CRC64 continues the checksum crc over p.
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crcTable[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
@@ -0,0 +1,17 @@
+package rdb
+
+import "testing"
+
+func TestCRC64(t *testing.T) {
+	// The check value from Redis' crc64.c.
+	if got := CRC64(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("got %x, want e9c6d914c4b8d9ca", got)
+	}
+	// The checksum continues across calls.
+	if got := CRC64(CRC64(0, []byte("1234")), []byte("56789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("incremental: got %x", got)
+	}
+	if got := CRC64(0, nil); got != 0 {
+		t.Fatalf("empty: got %x", got)
+	}
+}
@@ -0,0 +1,731 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// ErrChecksum is returned when the checksum stored at the end of the file
+// does not match its contents.
+var ErrChecksum = errors.New("rdb: checksum mismatch")
+
+// Decoder reads an RDB file from a stream. Every byte read is folded into a
+// running CRC-64 so the trailing checksum can be verified.
+type Decoder struct {
+	r   *bufio.Reader
+	crc uint64
+
+	// Version is the format version from the header, set by Decode.
+	Version int
+	// Aux holds the auxiliary fields (redis-ver, ctime, ...) read so far.
+	Aux map[string]string
+	// Checksum is the checksum stored in the file, 0 if it was written
+	// with rdbchecksum disabled.
+	Checksum uint64
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), Aux: make(map[string]string)}
+}
+
+// Decode reads the whole file and calls fn for every key in it, in file
+// order. It stops at the first error returned by fn.
+func (d *Decoder) Decode(fn func(*Entry) error) error {
+	header, err := d.readN(9)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return errors.New("rdb: wrong signature")
+	}
+	d.Version, err = strconv.Atoi(string(header[5:]))
+	if err != nil || d.Version < 1 {
+		return fmt.Errorf("rdb: bad version %q", header[5:])
+	}
+	if d.Version > MaxVersion {
+		return fmt.Errorf("rdb: can't handle RDB format version %d", d.Version)
+	}
+
+	dbnum := 0
+	var expireAt int64
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opEOF:
+			return d.verifyChecksum()
+		case opSelectDB:
+			n, err := d.readLen()
+			if err != nil {
+				return err
+			}
+			dbnum = int(n)
+			continue
+		case opResizeDB:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+			continue
+		case opAux:
+			k, err := d.readString()
+			if err != nil {
+				return err
+			}
+			v, err := d.readString()
+			if err != nil {
+				return err
+			}
+			d.Aux[k] = v
+			continue
+		case opExpireTime:
+			b, err := d.readN(4)
+			if err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(b)) * 1000
+			continue
+		case opExpireTimeMs:
+			b, err := d.readN(8)
+			if err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(b))
+			continue
+		case opFreq:
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+			continue
+		case opIdle:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+			continue
+		case opFunction2:
+			// A function library; functions are not supported, skip it.
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+			continue
+		case opFunctionPreGA, opModuleAux:
+			return fmt.Errorf("rdb: unsupported opcode 0x%02x", op)
+		}
+
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		e := &Entry{DB: dbnum, Key: key, ExpireAt: expireAt}
+		expireAt = 0
+		if err := d.readValue(op, e); err != nil {
+			return fmt.Errorf("%w (key %q)", err, key)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Decoder) verifyChecksum() error {
+	if d.Version < 5 {
+		return nil
+	}
+	expected := d.crc
+	b, err := d.readN(8)
+	if err != nil {
+		return err
+	}
+	d.Checksum = binary.LittleEndian.Uint64(b)
+	if d.Checksum != 0 && d.Checksum != expected {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func (d *Decoder) readValue(t byte, e *Entry) error {
+	var err error
+	switch t {
+	case typeString:
+		e.Kind = KindString
+		e.Value, err = d.readString()
+	case typeList, typeSet:
+		e.Kind = KindList
+		if t == typeSet {
+			e.Kind = KindSet
+		}
+		e.Value, err = d.readStrings()
+	case typeZSet, typeZSet2:
+		e.Kind = KindZSet
+		e.Value, err = d.readZSet(t == typeZSet2)
+	case typeHash:
+		e.Kind = KindHash
+		var items []string
+		if items, err = d.readStringPairs(); err == nil {
+			e.Value, err = pairsToHash(items)
+		}
+	case typeHashZipmap, typeHashZiplist, typeHashListpack:
+		e.Kind = KindHash
+		var items []string
+		if items, err = d.readBlob(t); err == nil {
+			e.Value, err = pairsToHash(items)
+		}
+	case typeListZiplist:
+		e.Kind = KindList
+		e.Value, err = d.readBlob(t)
+	case typeSetIntset, typeSetListpack:
+		e.Kind = KindSet
+		e.Value, err = d.readBlob(t)
+	case typeZSetZiplist, typeZSetListpack:
+		e.Kind = KindZSet
+		var items []string
+		if items, err = d.readBlob(t); err == nil {
+			e.Value, err = pairsToZSet(items)
+		}
+	case typeListQuicklist, typeListQuicklist2:
+		e.Kind = KindList
+		e.Value, err = d.readQuicklist(t == typeListQuicklist2)
+	case typeStreamListpacks, typeStreamListpack2, typeStreamListpack3:
+		e.Kind = KindStream
+		e.Value, err = d.readStream(t)
+	case typeModulePreGA, typeModule2:
+		err = errors.New("rdb: module values are not supported")
+	default:
+		err = fmt.Errorf("rdb: unknown value type %d", t)
+	}
+	return err
+}
+
+func (d *Decoder) readStrings() ([]string, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]string, 0, min(n, 1024))
+	for i := uint64(0); i < n; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+func (d *Decoder) readStringPairs() ([]string, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]string, 0, min(2*n, 1024))
+	for i := uint64(0); i < 2*n; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+func (d *Decoder) readZSet(binaryScores bool) ([]ZMember, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]ZMember, 0, min(n, 1024))
+	for i := uint64(0); i < n; i++ {
+		m, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if binaryScores {
+			b, err := d.readN(8)
+			if err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		} else if score, err = d.readDoubleString(); err != nil {
+			return nil, err
+		}
+		members = append(members, ZMember{Member: m, Score: score})
+	}
+	return members, nil
+}
+
+// readDoubleString reads the old textual score encoding: a length byte
+// (253 NaN, 254 +inf, 255 -inf) followed by that many ASCII bytes.
+func (d *Decoder) readDoubleString() (float64, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := d.readN(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+// readBlob reads a string holding a single ziplist, listpack, intset or
+// zipmap and returns its decoded entries.
+func (d *Decoder) readBlob(t byte) ([]string, error) {
+	s, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	b := []byte(s)
+	switch t {
+	case typeHashZipmap:
+		return decodeZipmap(b)
+	case typeListZiplist, typeZSetZiplist, typeHashZiplist:
+		return decodeZiplist(b)
+	case typeSetIntset:
+		return decodeIntset(b)
+	}
+	return decodeListpack(b)
+}
+
+// readQuicklist reads a list stored as a sequence of ziplist nodes, or for
+// quicklist2 as listpack nodes that may also be plain single elements.
+func (d *Decoder) readQuicklist(v2 bool) ([]string, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for i := uint64(0); i < n; i++ {
+		container := uint64(2) // packed
+		if v2 {
+			if container, err = d.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if container == 1 { // plain
+			items = append(items, s)
+			continue
+		}
+		var node []string
+		if v2 {
+			node, err = decodeListpack([]byte(s))
+		} else {
+			node, err = decodeZiplist([]byte(s))
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, node...)
+	}
+	return items, nil
+}
+
+// Stream entry flags inside a listpack node.
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+// readStream reads a stream stored as a radix tree of listpack nodes, then
+// its metadata and consumer groups.
+//
+// Each node is keyed by its master ID and its listpack starts with a master
+// entry (count, deleted, field names, 0). Every following entry is
+//
+//	flags ms-delta seq-delta [num-fields] (field value | value)... lp-count
+//
+// with the field names omitted when they match the master entry.
+func (d *Decoder) readStream(t byte) (*Stream, error) {
+	nodes, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	st := &Stream{}
+	for i := uint64(0); i < nodes; i++ {
+		key, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, errors.New("rdb: bad stream node key")
+		}
+		master := StreamID{
+			Ms:  binary.BigEndian.Uint64([]byte(key[:8])),
+			Seq: binary.BigEndian.Uint64([]byte(key[8:])),
+		}
+		lp, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		items, err := decodeListpack([]byte(lp))
+		if err != nil {
+			return nil, err
+		}
+		entries, err := streamNodeEntries(master, items)
+		if err != nil {
+			return nil, err
+		}
+		st.Entries = append(st.Entries, entries...)
+	}
+
+	// length, last_id
+	if _, err := d.readLen(); err != nil {
+		return nil, err
+	}
+	if st.LastID, err = d.readStreamID(); err != nil {
+		return nil, err
+	}
+	if t >= typeStreamListpack2 {
+		// first_id, max_deleted_entry_id, entries_added
+		if _, err := d.readStreamID(); err != nil {
+			return nil, err
+		}
+		if _, err := d.readStreamID(); err != nil {
+			return nil, err
+		}
+		if _, err := d.readLen(); err != nil {
+			return nil, err
+		}
+	}
+	return st, d.skipConsumerGroups(t)
+}
+
+func streamNodeEntries(master StreamID, items []string) ([]StreamEntry, error) {
+	p := 0
+	next := func() (string, bool) {
+		if p >= len(items) {
+			return "", false
+		}
+		p++
+		return items[p-1], true
+	}
+	nextInt := func() (int64, bool) {
+		s, ok := next()
+		if !ok {
+			return 0, false
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		return v, err == nil
+	}
+	corrupt := errors.New("rdb: corrupt stream node")
+
+	// Master entry: count, deleted, num master fields, fields..., 0.
+	count, ok1 := nextInt()
+	deleted, ok2 := nextInt()
+	nfields, ok3 := nextInt()
+	if !ok1 || !ok2 || !ok3 || nfields < 0 || nfields >= int64(len(items)-p) {
+		return nil, corrupt
+	}
+	masterFields := items[p : p+int(nfields)]
+	p += int(nfields) + 1
+
+	var entries []StreamEntry
+	for n := count + deleted; n > 0; n-- {
+		flags, ok1 := nextInt()
+		msDelta, ok2 := nextInt()
+		seqDelta, ok3 := nextInt()
+		if !ok1 || !ok2 || !ok3 {
+			return nil, corrupt
+		}
+		e := StreamEntry{ID: StreamID{
+			Ms:  master.Ms + uint64(msDelta),
+			Seq: master.Seq + uint64(seqDelta),
+		}}
+		if flags&streamItemSameFields != 0 {
+			for _, f := range masterFields {
+				v, ok := next()
+				if !ok {
+					return nil, corrupt
+				}
+				e.Fields = append(e.Fields, f, v)
+			}
+		} else {
+			num, ok := nextInt()
+			if !ok || num < 0 || num > int64(len(items)-p)/2 {
+				return nil, corrupt
+			}
+			e.Fields = append(e.Fields, items[p:p+2*int(num)]...)
+			p += 2 * int(num)
+		}
+		if _, ok := next(); !ok { // lp-count
+			return nil, corrupt
+		}
+		if flags&streamItemDeleted == 0 {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (d *Decoder) readStreamID() (StreamID, error) {
+	ms, err := d.readLen()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := d.readLen()
+	if err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// skipConsumerGroups reads past the consumer groups of a stream, with their
+// pending entries lists and consumers.
+func (d *Decoder) skipConsumerGroups(t byte) error {
+	groups, err := d.readLen()
+	if err != nil {
+		return err
+	}
+	for ; groups > 0; groups-- {
+		if _, err := d.readString(); err != nil { // name
+			return err
+		}
+		if _, err := d.readStreamID(); err != nil { // last delivered
+			return err
+		}
+		if t >= typeStreamListpack2 {
+			if _, err := d.readLen(); err != nil { // entries_read
+				return err
+			}
+		}
+		pel, err := d.readLen()
+		if err != nil {
+			return err
+		}
+		for ; pel > 0; pel-- {
+			// raw ID, delivery time, delivery count
+			if _, err := d.readN(16 + 8); err != nil {
+				return err
+			}
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+		}
+		consumers, err := d.readLen()
+		if err != nil {
+			return err
+		}
+		for ; consumers > 0; consumers-- {
+			if _, err := d.readString(); err != nil { // name
+				return err
+			}
+			times := 8 // seen time
+			if t >= typeStreamListpack3 {
+				times += 8 // active time
+			}
+			if _, err := d.readN(times); err != nil {
+				return err
+			}
+			n, err := d.readLen()
+			if err != nil {
+				return err
+			}
+			if _, err := d.readN(16 * int(n)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func pairsToHash(items []string) (map[string]string, error) {
+	if len(items)%2 != 0 {
+		return nil, errors.New("rdb: odd number of hash elements")
+	}
+	h := make(map[string]string, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		h[items[i]] = items[i+1]
+	}
+	return h, nil
+}
+
+func pairsToZSet(items []string) ([]ZMember, error) {
+	if len(items)%2 != 0 {
+		return nil, errors.New("rdb: odd number of sorted set elements")
+	}
+	members := make([]ZMember, 0, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		score, err := strconv.ParseFloat(items[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("rdb: bad sorted set score %q", items[i+1])
+		}
+		members = append(members, ZMember{Member: items[i], Score: score})
+	}
+	return members, nil
+}
+
+// Length encoding: the two high bits of the first byte select a 6-bit
+// length, a 14-bit length, a 32/64-bit big endian length (0x80/0x81), or a
+// special string encoding whose kind is in the low six bits.
+const (
+	len6bit   = 0
+	len14bit  = 1
+	len32or64 = 2
+	lenEncVal = 3
+
+	len32 = 0x80
+	len64 = 0x81
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+// maxStringLen bounds the uncompressed length of an LZF string, which is
+// allocated before any of it is read; it is Redis' default
+// proto-max-bulk-len.
+const maxStringLen = 512 << 20
+
+// readLength returns a length, or with encoded set the kind of special
+// string encoding that follows.
+func (d *Decoder) readLength() (n uint64, encoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case len6bit:
+		return uint64(b & 0x3f), false, nil
+	case len14bit:
+		next, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case lenEncVal:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case len32:
+		p, err := d.readN(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case len64:
+		p, err := d.readN(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, fmt.Errorf("rdb: unknown length encoding 0x%02x", b)
+}
+
+func (d *Decoder) readLen() (uint64, error) {
+	n, encoded, err := d.readLength()
+	if err == nil && encoded {
+		err = errors.New("rdb: unexpected encoded string where a length was expected")
+	}
+	return n, err
+}
+
+func (d *Decoder) readString() (string, error) {
+	n, encoded, err := d.readLength()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		b, err := d.readN(int(n))
+		return string(b), err
+	}
+	switch n {
+	case encInt8:
+		b, err := d.readN(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case encInt16:
+		b, err := d.readN(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case encInt32:
+		b, err := d.readN(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case encLZF:
+		clen, err := d.readLen()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := d.readLen()
+		if err != nil {
+			return "", err
+		}
+		if ulen > maxStringLen {
+			return "", fmt.Errorf("rdb: compressed string of %d bytes is too long", ulen)
+		}
+		in, err := d.readN(int(clen))
+		if err != nil {
+			return "", err
+		}
+		out, err := lzfDecompress(in, int(ulen))
+		return string(out), err
+	}
+	return "", fmt.Errorf("rdb: unknown string encoding %d", n)
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.readN(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readN(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, errors.New("rdb: bad length")
+	}
+	var b []byte
+	if n <= 1<<20 {
+		b = make([]byte, n)
+		if _, err := io.ReadFull(d.r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	} else {
+		// Grow with the data actually read so a corrupt length can't make
+		// us allocate gigabytes up front.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		b = buf.Bytes()
+	}
+	d.crc = CRC64(d.crc, b)
+	return b, nil
+}
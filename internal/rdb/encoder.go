@@ -0,0 +1,346 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Version is the RDB format version the encoder writes, the one used by
+// Redis 7.0 to 7.2.
+const Version = 11
+
+// streamNodeMaxEntries caps the entries per stream listpack node, like the
+// stream-node-max-entries default.
+const streamNodeMaxEntries = 100
+
+// Encoder writes an RDB file. Every byte written is folded into a running
+// CRC-64, which WriteEOF appends as the trailing checksum.
+type Encoder struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// WriteHeader writes the magic string and format version.
+func (e *Encoder) WriteHeader() error {
+	e.write([]byte(fmt.Sprintf("REDIS%04d", Version)))
+	return e.err
+}
+
+// WriteAux writes an auxiliary field such as redis-ver or ctime.
+func (e *Encoder) WriteAux(key, value string) error {
+	e.write([]byte{opAux})
+	e.writeString(key)
+	e.writeString(value)
+	return e.err
+}
+
+// WriteSelectDB starts database db, giving the number of keys and of keys
+// with a TTL that follow as sizing hints for the loader.
+func (e *Encoder) WriteSelectDB(db, keys, expires int) error {
+	e.write([]byte{opSelectDB})
+	e.writeLen(uint64(db))
+	e.write([]byte{opResizeDB})
+	e.writeLen(uint64(keys))
+	e.writeLen(uint64(expires))
+	return e.err
+}
+
+// WriteEntry writes one key with its value and TTL. Entry.DB is ignored;
+// keys belong to the database of the last WriteSelectDB.
+func (e *Encoder) WriteEntry(ent *Entry) error {
+	if ent.ExpireAt != 0 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(ent.ExpireAt))
+		e.write([]byte{opExpireTimeMs})
+		e.write(b[:])
+	}
+	switch v := ent.Value.(type) {
+	case string:
+		e.write([]byte{typeString})
+		e.writeString(ent.Key)
+		e.writeString(v)
+	case []string:
+		t := byte(typeList)
+		if ent.Kind == KindSet {
+			t = typeSet
+		}
+		e.write([]byte{t})
+		e.writeString(ent.Key)
+		e.writeLen(uint64(len(v)))
+		for _, s := range v {
+			e.writeString(s)
+		}
+	case []ZMember:
+		e.write([]byte{typeZSet2})
+		e.writeString(ent.Key)
+		e.writeLen(uint64(len(v)))
+		var b [8]byte
+		for _, m := range v {
+			e.writeString(m.Member)
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(m.Score))
+			e.write(b[:])
+		}
+	case map[string]string:
+		e.write([]byte{typeHash})
+		e.writeString(ent.Key)
+		e.writeLen(uint64(len(v)))
+		fields := make([]string, 0, len(v))
+		for f := range v {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		for _, f := range fields {
+			e.writeString(f)
+			e.writeString(v[f])
+		}
+	case *Stream:
+		e.write([]byte{typeStreamListpack3})
+		e.writeString(ent.Key)
+		e.writeStream(v)
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("rdb: cannot encode %T", ent.Value)
+		}
+	}
+	return e.err
+}
+
+// writeStream writes a stream as listpack nodes of up to
+// streamNodeMaxEntries entries, in the layout readStream expects, followed
+// by its metadata and no consumer groups.
+func (e *Encoder) writeStream(st *Stream) {
+	nodes := (len(st.Entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	e.writeLen(uint64(nodes))
+	for start := 0; start < len(st.Entries); start += streamNodeMaxEntries {
+		entries := st.Entries[start:min(start+streamNodeMaxEntries, len(st.Entries))]
+		master := entries[0].ID
+		var key [16]byte
+		binary.BigEndian.PutUint64(key[:8], master.Ms)
+		binary.BigEndian.PutUint64(key[8:], master.Seq)
+		e.writeString(string(key[:]))
+		e.writeString(string(streamNodeListpack(master, entries)))
+	}
+
+	var first StreamID
+	if len(st.Entries) > 0 {
+		first = st.Entries[0].ID
+	}
+	lastID := st.LastID
+	if len(st.Entries) > 0 && lastID == (StreamID{}) {
+		lastID = st.Entries[len(st.Entries)-1].ID
+	}
+	e.writeLen(uint64(len(st.Entries)))
+	e.writeLen(lastID.Ms)
+	e.writeLen(lastID.Seq)
+	e.writeLen(first.Ms)
+	e.writeLen(first.Seq)
+	e.writeLen(0) // max deleted entry ID
+	e.writeLen(0)
+	e.writeLen(uint64(len(st.Entries))) // entries added
+	e.writeLen(0)                       // consumer groups
+}
+
+// streamNodeListpack builds the listpack of one stream node. The master
+// entry takes the field names of the first entry, and entries with the
+// same names in the same order store only their values.
+func streamNodeListpack(master StreamID, entries []StreamEntry) []byte {
+	var masterFields []string
+	for i := 0; i < len(entries[0].Fields); i += 2 {
+		masterFields = append(masterFields, entries[0].Fields[i])
+	}
+	lp := newListpack()
+	lp.appendInt(int64(len(entries))) // count
+	lp.appendInt(0)                   // deleted
+	lp.appendInt(int64(len(masterFields)))
+	for _, f := range masterFields {
+		lp.appendString(f)
+	}
+	lp.appendInt(0)
+
+	for _, ent := range entries {
+		same := len(ent.Fields) == 2*len(masterFields)
+		for i := 0; same && i < len(masterFields); i++ {
+			same = ent.Fields[2*i] == masterFields[i]
+		}
+		n := 0
+		flags := int64(0)
+		if same {
+			flags = streamItemSameFields
+		}
+		lp.appendInt(flags)
+		lp.appendInt(int64(ent.ID.Ms - master.Ms))
+		lp.appendInt(int64(ent.ID.Seq - master.Seq))
+		n += 3
+		if same {
+			for i := 1; i < len(ent.Fields); i += 2 {
+				lp.appendString(ent.Fields[i])
+				n++
+			}
+		} else {
+			lp.appendInt(int64(len(ent.Fields) / 2))
+			n++
+			for _, s := range ent.Fields {
+				lp.appendString(s)
+				n++
+			}
+		}
+		// lp-count: the number of elements of this entry, so it can be
+		// walked backwards.
+		lp.appendInt(int64(n))
+	}
+	return lp.bytes()
+}
+
+// WriteEOF ends the file with the EOF opcode and checksum, and flushes.
+func (e *Encoder) WriteEOF() error {
+	e.write([]byte{opEOF})
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], e.crc)
+	e.write(b[:])
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	return e.err
+}
+
+func (e *Encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	e.crc = CRC64(e.crc, p)
+	_, e.err = e.w.Write(p)
+}
+
+func (e *Encoder) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.write([]byte{byte(n)})
+	case n < 1<<14:
+		e.write([]byte{len14bit<<6 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		var b [5]byte
+		b[0] = len32
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		e.write(b[:])
+	default:
+		var b [9]byte
+		b[0] = len64
+		binary.BigEndian.PutUint64(b[1:], n)
+		e.write(b[:])
+	}
+}
+
+// writeString writes s, as an integer encoding when it is the canonical
+// decimal form of a value that fits in 32 bits.
+func (e *Encoder) writeString(s string) {
+	if len(s) <= 11 {
+		if v, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(v, 10) == s {
+			switch {
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				e.write([]byte{lenEncVal<<6 | encInt8, byte(v)})
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				e.write([]byte{lenEncVal<<6 | encInt16, byte(v), byte(v >> 8)})
+			default:
+				b := []byte{lenEncVal<<6 | encInt32, 0, 0, 0, 0}
+				binary.LittleEndian.PutUint32(b[1:], uint32(v))
+				e.write(b)
+			}
+			return
+		}
+	}
+	e.writeLen(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+// listpack builds a listpack blob; see decodeListpack for the layout.
+type listpack struct {
+	buf []byte
+	n   int
+}
+
+func newListpack() *listpack {
+	return &listpack{buf: make([]byte, 6, 64)}
+}
+
+// appendString appends s, as an integer element when it is the canonical
+// decimal form of an int64, as Redis does.
+func (lp *listpack) appendString(s string) {
+	if len(s) <= 20 {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+			lp.appendInt(v)
+			return
+		}
+	}
+	var enc []byte
+	switch n := len(s); {
+	case n < 64:
+		enc = append([]byte{0x80 | byte(n)}, s...)
+	case n < 4096:
+		enc = append([]byte{0xe0 | byte(n>>8), byte(n)}, s...)
+	default:
+		enc = []byte{0xf0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(enc[1:], uint32(n))
+		enc = append(enc, s...)
+	}
+	lp.appendEncoded(enc)
+}
+
+func (lp *listpack) appendInt(v int64) {
+	var enc []byte
+	switch {
+	case v >= 0 && v <= 127:
+		enc = []byte{byte(v)}
+	case v >= -4096 && v <= 4095:
+		u := uint64(v) & 0x1fff
+		enc = []byte{0xc0 | byte(u>>8), byte(u)}
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		enc = []byte{0xf1, byte(v), byte(v >> 8)}
+	case v >= -1<<23 && v < 1<<23:
+		enc = []byte{0xf2, byte(v), byte(v >> 8), byte(v >> 16)}
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		enc = []byte{0xf3, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(enc[1:], uint32(v))
+	default:
+		enc = []byte{0xf4, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(enc[1:], uint64(v))
+	}
+	lp.appendEncoded(enc)
+}
+
+// appendEncoded appends an element and its backlen: the element size in
+// 7-bit groups, most significant first, with the high bit set on all but
+// the first byte so it can be read from its last byte backwards.
+func (lp *listpack) appendEncoded(enc []byte) {
+	lp.buf = append(lp.buf, enc...)
+	l := uint64(len(enc))
+	size := backlenSize(len(enc))
+	for i := size - 1; i >= 0; i-- {
+		b := byte(l>>(7*i)) & 127
+		if i != size-1 {
+			b |= 128
+		}
+		lp.buf = append(lp.buf, b)
+	}
+	lp.n++
+}
+
+func (lp *listpack) bytes() []byte {
+	b := append(lp.buf, 0xff)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	n := lp.n
+	if n > 65535 {
+		n = 65535 // unknown, count by walking
+	}
+	binary.LittleEndian.PutUint16(b[4:], uint16(n))
+	return b
+}
@@ -0,0 +1,280 @@
+package rdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// encodeFile writes entries as a complete RDB file in database 0.
+func encodeFile(t *testing.T, entries []*Entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteAux("redis-ver", "7.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteSelectDB(0, len(entries), 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := enc.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.WriteEOF(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeFile(b []byte) ([]*Entry, error) {
+	var entries []*Entry
+	err := NewDecoder(bytes.NewReader(b)).Decode(func(e *Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+func testStream(n int) *Stream {
+	st := &Stream{}
+	for i := 0; i < n; i++ {
+		id := StreamID{Ms: 1700000000000 + uint64(i/3), Seq: uint64(i % 3)}
+		fields := []string{"temp", strconv.Itoa(20 + i), "unit", "c"}
+		switch {
+		case i%7 == 3:
+			// Other field names than the node's master entry.
+			fields = []string{"humidity", "40", "note", strings.Repeat("x", i)}
+		case i%11 == 5:
+			// Same names in another order.
+			fields = []string{"unit", "f", "temp", "-" + strconv.Itoa(i)}
+		}
+		st.Entries = append(st.Entries, StreamEntry{ID: id, Fields: fields})
+	}
+	return st
+}
+
+func TestRoundTrip(t *testing.T) {
+	long := strings.Repeat("abcdefgh", 3000)
+	deleted := testStream(5)
+	deleted.LastID = StreamID{Ms: 1800000000000, Seq: 7}
+	tests := []struct {
+		name string
+		e    *Entry
+	}{
+		{"empty string", &Entry{Kind: KindString, Value: ""}},
+		{"short string", &Entry{Kind: KindString, Value: "hello"}},
+		{"binary string", &Entry{Kind: KindString, Value: "a\x00\r\n\xffb"}},
+		{"14-bit length", &Entry{Kind: KindString, Value: strings.Repeat("y", 1000)}},
+		{"32-bit length", &Entry{Kind: KindString, Value: long}},
+		{"int8", &Entry{Kind: KindString, Value: "-128"}},
+		{"int16", &Entry{Kind: KindString, Value: "32767"}},
+		{"int32", &Entry{Kind: KindString, Value: "-2147483648"}},
+		{"beyond int32", &Entry{Kind: KindString, Value: "2147483648"}},
+		{"leading zero", &Entry{Kind: KindString, Value: "007"}},
+		{"negative zero", &Entry{Kind: KindString, Value: "-0"}},
+		{"with expiry", &Entry{Kind: KindString, Value: "v", ExpireAt: 1893456000123}},
+		{"list", &Entry{Kind: KindList, Value: []string{"a", "1", "", long, "-5"}}},
+		{"set", &Entry{Kind: KindSet, Value: []string{"x", "y", "100000"}}},
+		{"zset", &Entry{Kind: KindZSet, Value: []ZMember{
+			{"a", 1.5}, {"b", -3}, {"c", math.Inf(1)}, {"d", math.Inf(-1)}, {"e", 0.1},
+		}}},
+		{"hash", &Entry{Kind: KindHash, Value: map[string]string{"f1": "v1", "f2": "", "12": "34"}}},
+		{"stream", &Entry{Kind: KindStream, Value: testStream(3)}},
+		{"stream of several nodes", &Entry{Kind: KindStream, Value: testStream(250)}},
+		{"stream with deleted tail", &Entry{Kind: KindStream, Value: deleted}},
+		{"empty stream", &Entry{Kind: KindStream, Value: &Stream{LastID: StreamID{Ms: 5, Seq: 1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.e.Key = "key:" + tt.name
+			got, err := decodeFile(encodeFile(t, []*Entry{tt.e}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := *tt.e
+			if st, ok := want.Value.(*Stream); ok && st.LastID == (StreamID{}) {
+				// The encoder stores the last entry's ID when none is set.
+				cp := *st
+				cp.LastID = st.Entries[len(st.Entries)-1].ID
+				want.Value = &cp
+			}
+			if len(got) != 1 || !reflect.DeepEqual(got[0], &want) {
+				t.Fatalf("got %+v, want %+v", got, &want)
+			}
+		})
+	}
+}
+
+func TestRoundTripSeveralKeys(t *testing.T) {
+	var entries []*Entry
+	for i := 0; i < 300; i++ {
+		entries = append(entries, &Entry{Key: fmt.Sprintf("k%d", i), Kind: KindString, Value: strconv.Itoa(i * 1000)})
+	}
+	got, err := decodeFile(encodeFile(t, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Fatalf("decoded %d keys that differ from the %d encoded", len(got), len(entries))
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	b := encodeFile(t, []*Entry{{Key: "k", Kind: KindString, Value: "some value"}})
+	d := NewDecoder(bytes.NewReader(b))
+	if err := d.Decode(func(*Entry) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if d.Checksum == 0 || d.Aux["redis-ver"] != "7.2.0" || d.Version != Version {
+		t.Fatalf("checksum %x, aux %v, version %d", d.Checksum, d.Aux, d.Version)
+	}
+
+	corrupt := bytes.Clone(b)
+	corrupt[len(corrupt)-12] ^= 1 // inside "some value"
+	if _, err := decodeFile(corrupt); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("corrupt value: got %v, want %v", err, ErrChecksum)
+	}
+
+	// A zero checksum means the file was written without one.
+	unchecked := bytes.Clone(b)
+	copy(unchecked[len(unchecked)-8:], make([]byte, 8))
+	if _, err := decodeFile(unchecked); err != nil {
+		t.Fatalf("zero checksum: %v", err)
+	}
+
+	if _, err := decodeFile(b[:len(b)-3]); err == nil {
+		t.Fatal("truncated file decoded without error")
+	}
+}
+
+func TestListpack(t *testing.T) {
+	ints := []int64{
+		0, 1, 127, 128, -1, -4096, 4095, 4096, -4097,
+		math.MaxInt16, math.MinInt16, math.MaxInt16 + 1, math.MinInt16 - 1,
+		1<<23 - 1, -1 << 23, 1 << 23, -1<<23 - 1,
+		math.MaxInt32, math.MinInt32, math.MaxInt32 + 1, math.MinInt32 - 1,
+		math.MaxInt64, math.MinInt64,
+	}
+	lp := newListpack()
+	var want []string
+	for _, v := range ints {
+		lp.appendInt(v)
+		want = append(want, strconv.FormatInt(v, 10))
+	}
+	for _, n := range []int{0, 1, 63, 64, 127, 128, 4095, 4096, 16383, 20000} {
+		s := strings.Repeat("s", n)
+		lp.appendString(s)
+		want = append(want, s)
+	}
+	// Strings that only look like integers stay strings.
+	for _, s := range []string{"-0", "01", "+1", "9223372036854775808", "1.5"} {
+		lp.appendString(s)
+		want = append(want, s)
+	}
+	got, err := decodeListpack(lp.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+}
+
+// TestBlobEncodings decodes the compact encodings Redis writes for small
+// values, built here with the listpack encoder.
+func TestBlobEncodings(t *testing.T) {
+	blob := func(items ...string) string {
+		lp := newListpack()
+		for _, s := range items {
+			lp.appendString(s)
+		}
+		return string(lp.bytes())
+	}
+	tests := []struct {
+		name string
+		t    byte
+		blob string
+		want *Entry
+	}{
+		{"set listpack", typeSetListpack, blob("a", "17", "-300"),
+			&Entry{Kind: KindSet, Value: []string{"a", "17", "-300"}}},
+		{"hash listpack", typeHashListpack, blob("f", "v", "n", "42"),
+			&Entry{Kind: KindHash, Value: map[string]string{"f": "v", "n": "42"}}},
+		{"zset listpack", typeZSetListpack, blob("a", "1", "b", "2.5"),
+			&Entry{Kind: KindZSet, Value: []ZMember{{"a", 1}, {"b", 2.5}}}},
+		{"intset", typeSetIntset, "\x02\x00\x00\x00\x03\x00\x00\x00\x00\x80\xff\xff\x01\x00",
+			&Entry{Kind: KindSet, Value: []string{"-32768", "-1", "1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf)
+			enc.WriteHeader()
+			enc.write([]byte{tt.t})
+			enc.writeString("k")
+			enc.writeString(tt.blob)
+			if err := enc.WriteEOF(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeFile(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Key = "k"
+			if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLZFString(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.WriteHeader()
+	enc.write([]byte{typeString})
+	enc.writeString("k")
+	compressed := []byte{0x02, 'a', 'b', 'c', 0x80, 0x02} // "abc" then 6 bytes from 3 back
+	enc.write([]byte{lenEncVal<<6 | encLZF})
+	enc.writeLen(uint64(len(compressed)))
+	enc.writeLen(9)
+	enc.write(compressed)
+	if err := enc.WriteEOF(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeFile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Value != "abcabcabc" {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestLZFStringTooLong(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.WriteHeader()
+	enc.write([]byte{typeString})
+	enc.writeString("k")
+	enc.write([]byte{lenEncVal<<6 | encLZF})
+	enc.writeLen(2)
+	enc.writeLen(1 << 62)
+	enc.write([]byte{0x00, 'a'})
+	if err := enc.WriteEOF(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeFile(buf.Bytes()); err == nil {
+		t.Fatal("decoded a string claiming 2^62 bytes")
+	}
+}
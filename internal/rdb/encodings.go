@@ -0,0 +1,292 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+var (
+	errZiplistCorrupt  = errors.New("rdb: corrupt ziplist")
+	errListpackCorrupt = errors.New("rdb: corrupt listpack")
+	errIntsetCorrupt   = errors.New("rdb: corrupt intset")
+	errZipmapCorrupt   = errors.New("rdb: corrupt zipmap")
+)
+
+// decodeZiplist returns the entries of a ziplist blob, with integer entries
+// rendered in decimal.
+//
+//	<zlbytes:u32><zltail:u32><zllen:u16><entry>...<0xff>
+func decodeZiplist(b []byte) ([]string, error) {
+	if len(b) < 11 || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return nil, errZiplistCorrupt
+	}
+	var items []string
+	i := 10
+	for {
+		if i >= len(b) {
+			return nil, errZiplistCorrupt
+		}
+		if b[i] == 0xff {
+			return items, nil
+		}
+		// The previous entry length is 1 byte, or 0xfe and 4 more bytes.
+		if b[i] == 0xfe {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errZiplistCorrupt
+		}
+		enc := b[i]
+		var item string
+		var n int
+		switch {
+		case enc>>6 == 0:
+			n = int(enc & 0x3f)
+			i++
+		case enc>>6 == 1:
+			if i+1 >= len(b) {
+				return nil, errZiplistCorrupt
+			}
+			n = int(enc&0x3f)<<8 | int(b[i+1])
+			i += 2
+		case enc == 0x80:
+			if i+5 > len(b) {
+				return nil, errZiplistCorrupt
+			}
+			n = int(binary.BigEndian.Uint32(b[i+1:]))
+			i += 5
+		default:
+			v, size, ok := ziplistInt(b[i:])
+			if !ok {
+				return nil, errZiplistCorrupt
+			}
+			items = append(items, strconv.FormatInt(v, 10))
+			i += size
+			continue
+		}
+		if n < 0 || i+n > len(b) {
+			return nil, errZiplistCorrupt
+		}
+		item = string(b[i : i+n])
+		items = append(items, item)
+		i += n
+	}
+}
+
+// ziplistInt decodes an integer entry whose encoding byte starts b. It
+// returns the value and the size of encoding plus payload.
+func ziplistInt(b []byte) (int64, int, bool) {
+	enc := b[0]
+	need := func(n int) bool { return len(b) >= 1+n }
+	switch enc {
+	case 0xc0:
+		if !need(2) {
+			return 0, 0, false
+		}
+		return int64(int16(binary.LittleEndian.Uint16(b[1:]))), 3, true
+	case 0xd0:
+		if !need(4) {
+			return 0, 0, false
+		}
+		return int64(int32(binary.LittleEndian.Uint32(b[1:]))), 5, true
+	case 0xe0:
+		if !need(8) {
+			return 0, 0, false
+		}
+		return int64(binary.LittleEndian.Uint64(b[1:])), 9, true
+	case 0xf0:
+		if !need(3) {
+			return 0, 0, false
+		}
+		v := int32(uint32(b[1])<<8|uint32(b[2])<<16|uint32(b[3])<<24) >> 8
+		return int64(v), 4, true
+	case 0xfe:
+		if !need(1) {
+			return 0, 0, false
+		}
+		return int64(int8(b[1])), 2, true
+	}
+	if enc >= 0xf1 && enc <= 0xfd {
+		return int64(enc&0x0f) - 1, 1, true
+	}
+	return 0, 0, false
+}
+
+// decodeListpack returns the entries of a listpack blob, with integer
+// entries rendered in decimal.
+//
+//	<total-bytes:u32><num-elements:u16><entry>...<0xff>
+//
+// Each entry is <encoding+data><backlen>, where backlen stores the size of
+// encoding+data in 1 to 5 bytes.
+func decodeListpack(b []byte) ([]string, error) {
+	if len(b) < 7 || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return nil, errListpackCorrupt
+	}
+	var items []string
+	i := 6
+	for {
+		if i >= len(b) {
+			return nil, errListpackCorrupt
+		}
+		enc := b[i]
+		if enc == 0xff {
+			return items, nil
+		}
+		var item string
+		var size int // encoding + data
+		switch {
+		case enc&0x80 == 0:
+			item = strconv.Itoa(int(enc & 0x7f))
+			size = 1
+		case enc&0xc0 == 0x80:
+			n := int(enc & 0x3f)
+			size = 1 + n
+			if i+size > len(b) {
+				return nil, errListpackCorrupt
+			}
+			item = string(b[i+1 : i+size])
+		case enc&0xe0 == 0xc0:
+			if i+2 > len(b) {
+				return nil, errListpackCorrupt
+			}
+			v := int(enc&0x1f)<<8 | int(b[i+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			item = strconv.Itoa(v)
+			size = 2
+		case enc&0xf0 == 0xe0:
+			if i+2 > len(b) {
+				return nil, errListpackCorrupt
+			}
+			n := int(enc&0x0f)<<8 | int(b[i+1])
+			size = 2 + n
+			if i+size > len(b) {
+				return nil, errListpackCorrupt
+			}
+			item = string(b[i+2 : i+size])
+		case enc == 0xf0:
+			if i+5 > len(b) {
+				return nil, errListpackCorrupt
+			}
+			n := int(binary.LittleEndian.Uint32(b[i+1:]))
+			size = 5 + n
+			if n < 0 || i+size > len(b) {
+				return nil, errListpackCorrupt
+			}
+			item = string(b[i+5 : i+size])
+		case enc >= 0xf1 && enc <= 0xf4:
+			width := map[byte]int{0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}[enc]
+			size = 1 + width
+			if i+size > len(b) {
+				return nil, errListpackCorrupt
+			}
+			var u uint64
+			for j := 0; j < width; j++ {
+				u |= uint64(b[i+1+j]) << (8 * j)
+			}
+			// Sign-extend from width bytes.
+			shift := 64 - 8*width
+			item = strconv.FormatInt(int64(u<<shift)>>shift, 10)
+		default:
+			return nil, errListpackCorrupt
+		}
+		items = append(items, item)
+		i += size + backlenSize(size)
+	}
+}
+
+func backlenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// decodeIntset returns the members of an intset blob in decimal.
+//
+//	<encoding:u32><length:u32><int>...
+func decodeIntset(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, errIntsetCorrupt
+	}
+	width := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(b) != 8+n*width {
+		return nil, errIntsetCorrupt
+	}
+	items := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		p := b[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		items = append(items, strconv.FormatInt(v, 10))
+	}
+	return items, nil
+}
+
+// decodeZipmap returns the alternating fields and values of a zipmap, the
+// hash encoding used before Redis 2.6.
+//
+//	<zmlen:u8><len>field<len><free>value...<0xff>
+func decodeZipmap(b []byte) ([]string, error) {
+	var items []string
+	i := 1
+	readLen := func() (int, bool) {
+		if i >= len(b) {
+			return 0, false
+		}
+		switch {
+		case b[i] < 254:
+			n := int(b[i])
+			i++
+			return n, true
+		case b[i] == 254 && i+5 <= len(b):
+			n := int(binary.LittleEndian.Uint32(b[i+1:]))
+			i += 5
+			return n, true
+		}
+		return 0, false
+	}
+	for {
+		if i >= len(b) {
+			return nil, errZipmapCorrupt
+		}
+		if b[i] == 0xff {
+			return items, nil
+		}
+		n, ok := readLen()
+		if !ok || i+n > len(b) {
+			return nil, errZipmapCorrupt
+		}
+		field := string(b[i : i+n])
+		i += n
+		n, ok = readLen()
+		if !ok || i+1+n > len(b) {
+			return nil, errZipmapCorrupt
+		}
+		free := int(b[i])
+		i++
+		value := string(b[i : i+n])
+		i += n + free
+		items = append(items, field, value)
+	}
+}
@@ -0,0 +1,57 @@
+package rdb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLZFDecompress(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"literal", []byte{0x04, 'h', 'e', 'l', 'l', 'o'}, "hello"},
+		{"back reference", []byte{0x02, 'a', 'b', 'c', 0x80, 0x02}, "abcabcabc"},
+		// A reference overlapping the bytes it produces repeats them.
+		{"run", []byte{0x00, 'a', 0xe0, 0x00, 0x00}, strings.Repeat("a", 10)},
+		{"long run", []byte{0x00, 'z', 0xe0, 0xff, 0x00}, strings.Repeat("z", 265)},
+		{"literal after reference", []byte{0x01, 'a', 'b', 0x20, 0x01, 0x00, '!'}, "ababa!"},
+		{"13-bit offset", append(append([]byte{0x1f}, bytes.Repeat([]byte{'q'}, 32)...), 0x20, 0x1f),
+			strings.Repeat("q", 35)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lzfDecompress(tt.in, len(tt.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLZFDecompressCorrupt(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []byte
+		outLen int
+	}{
+		{"truncated literal", []byte{0x04, 'h', 'e'}, 5},
+		{"reference before start", []byte{0x00, 'a', 0x20, 0x05}, 4},
+		{"missing offset byte", []byte{0x00, 'a', 0x20}, 4},
+		{"missing length byte", []byte{0x00, 'a', 0xe0}, 12},
+		{"longer than declared", []byte{0x04, 'h', 'e', 'l', 'l', 'o'}, 3},
+		{"shorter than declared", []byte{0x04, 'h', 'e', 'l', 'l', 'o'}, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := lzfDecompress(tt.in, tt.outLen); err != errLZFCorrupt {
+				t.Fatalf("got %v, want %v", err, errLZFCorrupt)
+			}
+		})
+	}
+}
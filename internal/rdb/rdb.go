@@ -0,0 +1,138 @@
+// Package rdb reads Redis RDB snapshot files.
+package rdb
+
+import "fmt"
+
+// MaxVersion is the newest RDB format version the decoder understands
+// (Redis 7.0 to 7.2).
+const MaxVersion = 11
+
+// Opcodes that may appear where a value type byte is expected.
+const (
+	opFunctionPreGA = 0xf6
+	opFunction2     = 0xf5
+	opModuleAux     = 0xf7
+	opIdle          = 0xf8
+	opFreq          = 0xf9
+	opAux           = 0xfa
+	opResizeDB      = 0xfb
+	opExpireTimeMs  = 0xfc
+	opExpireTime    = 0xfd
+	opSelectDB      = 0xfe
+	opEOF           = 0xff
+)
+
+// Value type bytes.
+const (
+	typeString          = 0
+	typeList            = 1
+	typeSet             = 2
+	typeZSet            = 3
+	typeHash            = 4
+	typeZSet2           = 5
+	typeModulePreGA     = 6
+	typeModule2         = 7
+	typeHashZipmap      = 9
+	typeListZiplist     = 10
+	typeSetIntset       = 11
+	typeZSetZiplist     = 12
+	typeHashZiplist     = 13
+	typeListQuicklist   = 14
+	typeStreamListpacks = 15
+	typeHashListpack    = 16
+	typeZSetListpack    = 17
+	typeListQuicklist2  = 18
+	typeStreamListpack2 = 19
+	typeSetListpack     = 20
+	typeStreamListpack3 = 21
+)
+
+// Kind is the logical type of a decoded value, independent of the encoding
+// it was stored with.
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindList
+	KindSet
+	KindZSet
+	KindHash
+	KindStream
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindList:
+		return "list"
+	case KindSet:
+		return "set"
+	case KindZSet:
+		return "zset"
+	case KindHash:
+		return "hash"
+	case KindStream:
+		return "stream"
+	}
+	return "unknown"
+}
+
+// Entry is one key read from an RDB file. Value holds a string for
+// KindString, a []string for KindList and KindSet, a []ZMember for
+// KindZSet, a map[string]string for KindHash and a *Stream for KindStream.
+// ExpireAt is a unix time in milliseconds, or 0 if the key has no TTL.
+type Entry struct {
+	DB       int
+	Key      string
+	Kind     Kind
+	Value    interface{}
+	ExpireAt int64
+}
+
+// Len returns the number of elements in the value: the byte length of a
+// string, or the number of members, fields or stream entries.
+func (e *Entry) Len() int {
+	switch v := e.Value.(type) {
+	case string:
+		return len(v)
+	case []string:
+		return len(v)
+	case []ZMember:
+		return len(v)
+	case map[string]string:
+		return len(v)
+	case *Stream:
+		return len(v.Entries)
+	}
+	return 0
+}
+
+// ZMember is a sorted set member with its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// StreamID is a stream entry ID.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// StreamEntry is a stream entry; Fields alternates field names and values
+// in insertion order.
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// Stream is a stream value. Consumer groups are read but not kept.
+type Stream struct {
+	Entries []StreamEntry
+	LastID  StreamID
+}